@@ -1,507 +1,6447 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/gorilla/mux"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
 )
 
 // Configuration structure
 type Config struct {
-	Mode           string         `json:"mode"`           // "all" or "manual"
-	PowerLimit     uint32         `json:"powerLimit"`     // Default power limit in watts for "all" mode
-	ManualLimits   map[int]uint32 `json:"manualLimits"`   // GPU index to power limit map for "manual" mode
-	APIKey         string         `json:"apiKey"`         // API key for authentication
-	APIPort        int            `json:"apiPort"`        // Port for API server, default 8080
-	StartAPIServer bool           `json:"startAPIServer"` // Whether to start the API server
+	Mode                    string                    `json:"mode"`                    // "all", "manual" or "headroom"
+	PowerLimit              uint32                    `json:"powerLimit"`              // Default power limit in watts for "all" mode
+	PowerPercent            uint32                    `json:"powerLimitPercent"`       // Power limit as a percentage for "all" mode, used instead of powerLimit when set
+	PercentOf               string                    `json:"percentOf"`               // What percentages are relative to: "max" (default) or "default"
+	HeadroomWatts           uint32                    `json:"headroomWatts"`           // Watts above current usage for "headroom" mode
+	ManualLimits            map[int]uint32            `json:"manualLimits"`            // GPU index to power limit map for "manual" mode
+	GPULimits               []ManualLimit             `json:"gpuLimits"`               // Power limits for "manual" mode as a list, used instead of manualLimits when set
+	APIKey                  string                    `json:"apiKey"`                  // API key for authentication
+	APIKeys                 []APIKeyEntry             `json:"apiKeys"`                 // Additional labeled API keys
+	PersistAPIKeys          bool                      `json:"persistAPIKeys"`          // Whether key changes made through the API are written back to config.json
+	APIPort                 int                       `json:"apiPort"`                 // Port for API server, default 8080
+	StartAPIServer          bool                      `json:"startAPIServer"`          // Whether to start the API server
+	MetricsMaxStaleness     Duration                  `json:"metricsMaxStaleness"`     // How old power samples served on /metrics may be (default cacheTTL)
+	CacheTTL                Duration                  `json:"cacheTTL"`                // How long GET requests may be served from the GPU cache
+	JobTTL                  Duration                  `json:"jobTTL"`                  // How long finished async jobs can be queried, default 10m
+	IdempotencyTTL          Duration                  `json:"idempotencyTTL"`          // How long Idempotency-Key responses are remembered, default 10m
+	StreamInterval          Duration                  `json:"streamInterval"`          // How often /api/stream sends GPU information, default 1s
+	EnforceInterval         Duration                  `json:"enforceInterval"`         // How often the config limits are re-applied (0 = never)
+	WatchConfig             bool                      `json:"watchConfig"`             // Reload and re-apply the config file when it changes (enforce-only and API server modes)
+	DemandResponseFile      string                    `json:"demandResponseFile"`      // File holding a total wattage that is split across the GPUs whenever it changes
+	ExternalMeterCmd        string                    `json:"externalMeterCmd"`        // Command printing the facility power draw in watts, checked against externalMeterBudget
+	ExternalMeterBudget     uint32                    `json:"externalMeterBudget"`     // Facility power in watts above which GPUs are throttled
+	ExternalMeterInterval   Duration                  `json:"externalMeterInterval"`   // How often externalMeterCmd is run, default 10s
+	EnforceOnly             bool                      `json:"enforceOnly"`             // Stay resident re-applying limits without starting the API server
+	MonitorDrift            bool                      `json:"monitorDrift"`            // Log power limits changed by other processes without correcting them
+	DriftInterval           Duration                  `json:"driftInterval"`           // How often limits are checked for drift, default 30s
+	ServeDashboard          bool                      `json:"serveDashboard"`          // Whether to serve the web dashboard at /
+	MonitorEvents           bool                      `json:"monitorEvents"`           // Whether to watch for XID, power state and clock events
+	EventWebhookURL         string                    `json:"eventWebhookURL"`         // Optional URL that GPU events are POSTed to as JSON
+	MaxConcurrentRequests   int                       `json:"maxConcurrentRequests"`   // Maximum in-flight API requests, reads and writes combined (0 = unlimited)
+	ExposeMetrics           bool                      `json:"exposeMetrics"`           // Whether to serve Prometheus metrics at /metrics
+	MetricsUnits            string                    `json:"metricsUnits"`            // Power units in /metrics: "watts" (default), "milliwatts" or "both"
+	GPULabels               map[int]map[string]string `json:"gpuLabels"`               // Labels per GPU index, shown in GPU information and as /metrics labels
+	Groups                  map[string]GPUGroup       `json:"groups"`                  // Named sets of GPUs that are limited together
+	SysfsFallback           bool                      `json:"sysfsFallback"`           // Linux only: read power usage from hwmon in sysfs when NVML doesn't support it
+	DefaultStrict           bool                      `json:"defaultStrict"`           // Reject out-of-range limits instead of clamping, unless a request or flag says otherwise
+	DefaultDryRun           bool                      `json:"defaultDryRun"`           // Only report the limits that would be set, unless a request or flag says otherwise
+	RetryApplyUntilComplete Duration                  `json:"retryApplyUntilComplete"` // Keep retrying GPUs that failed to apply for up to this long
+	ApplyWhenIdle           *IdleWait                 `json:"applyWhenIdle"`           // Defer applying a reloaded config until every GPU is idle
+	AtomicApply             bool                      `json:"atomicApply"`             // Roll back every change if any GPU in the config fails to apply
+	DisabledOperations      []string                  `json:"disabledOperations"`      // API operations that answer 403: "power", "lockedClocks", "autoBoost", "fan", "keys"
+	JSONCase                string                    `json:"jsonCase"`                // Field name casing of GPU information in responses: "camel" (default) or "snake"
+	ClampLogging            string                    `json:"clampLogging"`            // Log clamped limits "always" (default), "once" per GPU and limit, or "off"
+	PolicyMaxWatts          uint32                    `json:"policyMaxWatts"`          // Site policy ceiling for any requested limit in watts (0 = hardware maximum only)
+	TLSCertFile             string                    `json:"tlsCertFile"`             // Optional certificate file to serve HTTPS (and HTTP/2) with
+	TLSKeyFile              string                    `json:"tlsKeyFile"`              // Private key file matching tlsCertFile
+	HTTP2Cleartext          bool                      `json:"http2Cleartext"`          // Whether to also accept HTTP/2 without TLS (h2c, prior knowledge)
+	ReadTimeout             Duration                  `json:"readTimeout"`             // Maximum time to read a request, default 10s
+	WriteTimeout            Duration                  `json:"writeTimeout"`            // Maximum time to write a response, default 30s (not applied to /api/stream)
+	IdleTimeout             Duration                  `json:"idleTimeout"`             // How long idle keep-alive connections stay open, default 2m
+	FailRate                float64                   `json:"failRate"`                // Test only: fraction of set operations that fail on purpose, needs --test-mode
+	SetCooldownMs           int                       `json:"setCooldownMs"`           // Minimum milliseconds between limit changes on the same GPU (0 = no minimum)
+	SettleDelayMs           int                       `json:"settleDelayMs"`           // Milliseconds to wait after a set before reading the GPU back (0 = none)
+	NVMLFailureThreshold    int                       `json:"nvmlFailureThreshold"`    // Consecutive NVML failures before calls are paused, default 5
+	NVMLCooldown            Duration                  `json:"nvmlCooldown"`            // How long NVML calls are paused before probing again, default 30s
+	StatsdAddr              string                    `json:"statsdAddr"`              // Optional host:port of a StatsD server that gauges are sent to over UDP
+	StatsdPrefix            string                    `json:"statsdPrefix"`            // Prefix of the StatsD metric names, default "nvidia_power"
+	StatsdInterval          Duration                  `json:"statsdInterval"`          // How often gauges are sent to StatsD, default 10s
+}
+
+// Power limit of one GPU in the gpuLimits list
+type ManualLimit struct {
+	Index int    `json:"index"` // GPU index
+	Watts uint32 `json:"watts"` // Power limit in watts
+}
+
+// Named set of GPUs sharing a power limit
+type GPUGroup struct {
+	Indices    []int  `json:"indices"`    // GPU indices in the group
+	PowerLimit uint32 `json:"powerLimit"` // Default power limit in watts applied with the config (0 = none)
+}
+
+// Wait for the GPUs to be idle before applying a reloaded config
+type IdleWait struct {
+	Utilization uint32   `json:"utilization"` // Every GPU must be below this utilization percentage, default 10
+	MaxWait     Duration `json:"maxWait"`     // Apply anyway after waiting this long, default 10m
+}
+
+// Request body for setting the power limit of a GPU group
+type GroupPowerRequest struct {
+	PowerLimit   uint32       `json:"powerLimit"`        // Power limit in watts, the group default when neither is set
+	PowerPercent uint32       `json:"powerLimitPercent"` // Power limit as a percentage, used instead of powerLimit when set
+	PercentOf    string       `json:"percentOf"`         // What percentages are relative to: "max" (default) or "default"
+	Strict       *bool        `json:"strict"`            // Reject out-of-range limits instead of clamping (default from config)
+	DryRun       *bool        `json:"dryRun"`            // Report the limits without setting them (default from config)
+	ClampPolicy  string       `json:"clampPolicy"`       // "clamp", "reject" or "rejectLowOnly", overrides strict when set
+	Ramp         *RampOptions `json:"ramp"`              // Step each GPU to its new limit gradually instead of at once, all GPUs together
+}
+
+// Optional request body for resetting a GPU to its default power limit
+type ResetRequest struct {
+	DryRun bool `json:"dryRun"` // Report the default limit without setting it (defaultDryRun doesn't apply)
+}
+
+// Labeled API key
+type APIKeyEntry struct {
+	Label        string   `json:"label"`
+	Key          string   `json:"key"`
+	Admin        bool     `json:"admin"`                  // Whether the key may manage other keys
+	ReadOnly     bool     `json:"readOnly"`               // Whether the key may only read GPU state, never change it
+	AllowedPaths []string `json:"allowedPaths,omitempty"` // API path prefixes the key may use besides /api/info and its own jobs, all of them when empty
+}
+
+// API key description returned by the API, never including the key itself
+type APIKeyLabel struct {
+	Label        string   `json:"label"`
+	Admin        bool     `json:"admin"`
+	ReadOnly     bool     `json:"readOnly"`
+	AllowedPaths []string `json:"allowedPaths,omitempty"`
+}
+
+// Response of /api/info describing the key the request was made with
+type APIInfo struct {
+	Key          APIKeyLabel `json:"key"`
+	Capabilities []string    `json:"capabilities"` // "read", "write" and "manageKeys"
+}
+
+// Label given to the key from the "apiKey" config field
+const legacyAPIKeyLabel = "default"
+
+// Duration that is read from config as a string such as "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s (expected a string such as \"500ms\")", data)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", value, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 // GPU information structure
 type GPUInfo struct {
-	Index      int    `json:"index"`
-	Name       string `json:"name"`
-	PowerLimit uint32 `json:"powerLimit"`      // Current power limit in watts
-	MinLimit   uint32 `json:"minLimit"`        // Minimum allowed power limit in watts
-	MaxLimit   uint32 `json:"maxLimit"`        // Maximum allowed power limit in watts
-	PowerUsage uint32 `json:"powerUsage"`      // Current power usage in watts
-	Supported  bool   `json:"powerManagement"` // Whether power management is supported
+	Index              int               `json:"index"`
+	Name               string            `json:"name"`
+	UUID               string            `json:"uuid"`                         // Stable identifier, unlike the index which can change between boots
+	PowerLimit         uint32            `json:"powerLimit"`                   // Current power limit in watts
+	EnforcedLimit      uint32            `json:"enforcedLimit"`                // Enforced power limit in watts, below powerLimit when another cap applies
+	MinLimit           uint32            `json:"minLimit"`                     // Minimum allowed power limit in watts
+	MaxLimit           uint32            `json:"maxLimit"`                     // Maximum allowed power limit in watts
+	PowerUsage         uint32            `json:"powerUsage"`                   // Current power usage in watts
+	PowerPercent       float64           `json:"powerPercent"`                 // Power usage as a percentage of the power limit (0 if there is no limit)
+	ModulePowerWatts   uint32            `json:"modulePowerWatts,omitempty"`   // Module power in watts (GPU, memory and other rails), on boards that report it
+	Utilization        uint32            `json:"utilization"`                  // Current GPU utilization in percent
+	MemoryTotalMB      uint64            `json:"memoryTotalMB"`                // Total memory in MiB
+	MemoryUsedMB       uint64            `json:"memoryUsedMB"`                 // Used memory in MiB
+	EccCurrent         bool              `json:"eccCurrent"`                   // Whether ECC is currently enabled
+	EccPending         bool              `json:"eccPending"`                   // Whether ECC will be enabled after the next reboot
+	Temperature        uint32            `json:"temperature"`                  // GPU core temperature in degrees Celsius
+	TempSlowdown       uint32            `json:"tempSlowdown,omitempty"`       // Temperature in degrees Celsius at which the GPU starts to throttle
+	TempShutdown       uint32            `json:"tempShutdown,omitempty"`       // Temperature in degrees Celsius at which the GPU shuts down
+	Serial             string            `json:"serial,omitempty"`             // Board serial number, not available on most consumer cards
+	VbiosVersion       string            `json:"vbiosVersion,omitempty"`       // VBIOS version
+	Supported          bool              `json:"powerManagement"`              // Whether power management is supported
+	SkipReason         string            `json:"skipReason,omitempty"`         // Why a set request left this GPU untouched
+	Unchanged          bool              `json:"unchanged,omitempty"`          // Whether a set request found the limit already in place
+	DryRun             bool              `json:"dryRun,omitempty"`             // Whether powerLimit is what a dry-run set request would apply
+	Clamped            bool              `json:"clamped,omitempty"`            // Whether a set request's limit was clamped to the allowed range or policy
+	RequestedLimit     uint32            `json:"requestedLimit,omitempty"`     // Limit in watts a clamped set request asked for
+	DriverModel        string            `json:"driverModel,omitempty"`        // Windows driver model, "WDDM" or "TCC"
+	DriverModelPending string            `json:"driverModelPending,omitempty"` // Driver model after the next reboot
+	AutoBoostEnabled   bool              `json:"autoBoostEnabled"`             // Whether auto-boosted clocks are enabled
+	AutoBoostSupported bool              `json:"autoBoostSupported"`           // Whether the GPU has auto-boost, deprecated on newer GPUs
+	PerfState          int               `json:"perfState"`                    // Current performance state, 0 (P0, highest) to 15, or -1 if unknown
+	PcieGen            int               `json:"pcieGen,omitempty"`            // Current PCIe link generation, which can drop at low power
+	PcieWidth          int               `json:"pcieWidth,omitempty"`          // Current PCIe link width (lanes)
+	Labels             map[string]string `json:"labels,omitempty"`             // Labels from gpuLabels in the config
+	NvlinkActiveLinks  int               `json:"nvlinkActiveLinks"`            // Number of active NVLink links, 0 without NVLink
+	NvlinkLinks        []NvlinkStatus    `json:"nvlinkLinks,omitempty"`        // Active NVLink links with their data counters
+	Group              string            `json:"group,omitempty"`              // Name of the config group the GPU belongs to
+}
+
+// snake_case names of fields whose camelCase names don't say what they hold
+// or don't split into words by case
+var snakeCaseNames = map[string]string{
+	"powerManagement": "power_management_supported",
+	"txKiB":           "tx_kib",
+	"rxKiB":           "rx_kib",
+}
+
+// Write GPU information as a JSON response line, with the field name casing from jsonCase
+func writeGPUJSON(w io.Writer, value interface{}) error {
+	data, err := marshalGPUJSON(value)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Encode GPU information with the field name casing from jsonCase
+func marshalGPUJSON(value interface{}) ([]byte, error) {
+	configMutex.RLock()
+	snake := jsonCase == "snake"
+	configMutex.RUnlock()
+	if !snake {
+		return json.Marshal(value)
+	}
+	return json.Marshal(snakeCaseValue(reflect.ValueOf(value)))
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// Copy of a value that encodes with snake_case struct field names at every
+// depth. Map keys are data, such as label names, and are kept as they are.
+func snakeCaseValue(value reflect.Value) interface{} {
+	if !value.IsValid() {
+		return nil
+	}
+	if value.Type().Implements(jsonMarshalerType) {
+		return value.Interface()
+	}
+
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return snakeCaseValue(value.Elem())
+	case reflect.Struct:
+		fields := jsonFields{}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" && options == "" {
+				continue
+			}
+			if strings.Contains(options, "omitempty") && isEmptyJSON(value.Field(i)) {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			snakeName, ok := snakeCaseNames[name]
+			if !ok {
+				snakeName = snakeCase(name)
+			}
+			fields = append(fields, jsonField{name: snakeName, value: snakeCaseValue(value.Field(i))})
+		}
+		return fields
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		entries := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			entries[fmt.Sprint(iter.Key().Interface())] = snakeCaseValue(iter.Value())
+		}
+		return entries
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return value.Interface() // Bytes encode as base64
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = snakeCaseValue(value.Index(i))
+		}
+		return items
+	}
+	return value.Interface()
+}
+
+// Whether omitempty leaves a field out of the encoding
+func isEmptyJSON(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return value.IsZero()
+}
+
+// JSON object fields, encoded in order
+type jsonFields []jsonField
+
+type jsonField struct {
+	name  string
+	value interface{}
+}
+
+func (fields jsonFields) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, field := range fields {
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.name)
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// Convert a camelCase name to snake_case, keeping acronyms together (memoryTotalMB is memory_total_mb)
+func snakeCase(name string) string {
+	isLower := func(c byte) bool { return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' }
+	var builder strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' {
+			if i > 0 && (isLower(name[i-1]) || i+1 < len(name) && isLower(name[i+1])) {
+				builder.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		builder.WriteByte(c)
+	}
+	return builder.String()
+}
+
+// Active NVLink link of a GPU
+type NvlinkStatus struct {
+	Link  int    `json:"link"`
+	TxKiB uint64 `json:"txKiB"` // Data sent over the link in KiB since the driver loaded, 0 if not reported
+	RxKiB uint64 `json:"rxKiB"` // Data received over the link in KiB since the driver loaded, 0 if not reported
+}
+
+// Power limit update request
+type PowerLimitRequest struct {
+	Mode          string         `json:"mode"`              // "all", "manual" or "headroom"
+	PowerLimit    uint32         `json:"powerLimit"`        // Power limit for all GPUs in watts
+	PowerPercent  uint32         `json:"powerLimitPercent"` // Power limit for all GPUs as a percentage, used instead of powerLimit when set
+	PercentOf     string         `json:"percentOf"`         // What percentages are relative to: "max" (default) or "default"
+	ManualLimits  map[int]uint32 `json:"manualLimits"`      // GPU index to power limit map
+	HeadroomWatts uint32         `json:"headroomWatts"`     // Watts above current usage for "headroom" mode
+	BusyThreshold uint32         `json:"busyThreshold"`     // Only apply to GPUs at or above this load percentage (0 = all)
+	SkipBusyGPUs  bool           `json:"skipBusyGPUs"`      // Leave GPUs with running compute processes untouched
+	Atomic        bool           `json:"atomic"`            // Manual mode: apply nothing unless every GPU and limit is valid
+	Strict        *bool          `json:"strict"`            // Reject out-of-range limits instead of clamping (default from config)
+	DryRun        *bool          `json:"dryRun"`            // Report the limits without setting them (default from config)
+	Async         bool           `json:"async"`             // Answer 202 with a job ID right away and apply in the background
+	Ramp          *RampOptions   `json:"ramp"`              // Step each GPU to its new limit gradually instead of at once, all GPUs together
+	ClampPolicy   string         `json:"clampPolicy"`       // "clamp", "reject" or "rejectLowOnly", overrides strict when set
+}
+
+// Gradual change from the current limit to the target in equal steps
+type RampOptions struct {
+	DurationMs int `json:"durationMs"` // Time from the first step to the target
+	Steps      int `json:"steps"`      // Number of limit changes, the last one being the target
+}
+
+// Limits accepted for ramps
+const (
+	maxRampSteps      = 100
+	maxRampDurationMs = 60000
+)
+
+// How a power limit is applied
+type applyOptions struct {
+	source    string       // What requested the change, recorded in the change log
+	strict    bool         // Reject limits outside the allowed range instead of clamping them
+	dryRun    bool         // Report the limit that would be set without setting it
+	ramp      *RampOptions // Reach the limit in steps instead of at once (nil = at once)
+	rollback  bool         // Undoing a failed change or restoring earlier limits, which setCooldown doesn't hold back
+	rejectLow bool         // Reject limits below the minimum even when not strict, still clamping ones above the maximum
+	benchmark bool         // Timing sets from --bench, which setCooldown doesn't hold back and the change log doesn't record
+}
+
+// Power limit given in watts, as a percentage or as headroom above current usage
+type limitValue struct {
+	watts    uint32
+	percent  uint32 // Used instead of watts when non-zero
+	headroom uint32 // Used instead of watts when headroom mode is set
+	overUse  bool   // Set the limit to current usage plus headroom
+}
+
+// Get the limit value applied to every GPU in "all" or "headroom" mode
+func allGPUsValue(mode string, powerLimit, powerPercent, headroomWatts uint32) limitValue {
+	if mode == "headroom" {
+		return limitValue{headroom: headroomWatts, overUse: true}
+	}
+	return limitValue{watts: powerLimit, percent: powerPercent}
+}
+
+// Conditions under which a set request leaves a GPU untouched
+type skipOptions struct {
+	busyThreshold uint32 // Skip GPUs whose load is below this percentage (0 = disabled)
+	skipBusy      bool   // Skip GPUs with running compute processes
+}
+
+// Locked GPU clocks update request
+type LockedClocksRequest struct {
+	MinClock uint32 `json:"minClock"` // Minimum GPU clock in MHz
+	MaxClock uint32 `json:"maxClock"` // Maximum GPU clock in MHz
+}
+
+// Locked GPU clocks state
+type LockedClocksInfo struct {
+	Index     int    `json:"index"`
+	MinClock  uint32 `json:"minClock,omitempty"` // Locked minimum GPU clock in MHz
+	MaxClock  uint32 `json:"maxClock,omitempty"` // Locked maximum GPU clock in MHz
+	Locked    bool   `json:"locked"`             // Whether the clocks are currently locked
+	Supported bool   `json:"supported"`          // Whether clock locking is supported
+}
+
+// Power limit range of a GPU in watts, for slider bounds
+type PowerRange struct {
+	Min     uint32 `json:"min"`     // Lowest limit the GPU accepts
+	Max     uint32 `json:"max"`     // Highest limit the GPU accepts
+	Default uint32 `json:"default"` // Default limit (stock TDP)
+}
+
+// Auto-boost update request
+type AutoBoostRequest struct {
+	Enabled *bool `json:"enabled"` // Whether the GPU may boost its clocks automatically
+}
+
+// Auto-boost state
+type AutoBoostInfo struct {
+	Index          int  `json:"index"`
+	Enabled        bool `json:"enabled"`        // Whether auto-boosted clocks are enabled
+	DefaultEnabled bool `json:"defaultEnabled"` // Whether they are enabled by default
+	Supported      bool `json:"supported"`      // Whether auto-boost can be queried and set, not on newer GPUs
+}
+
+// Fan speed update request, either a fixed speed or back to automatic
+type FanRequest struct {
+	Speed *int `json:"speed"` // Fixed speed in percent for every fan of the GPU
+	Auto  bool `json:"auto"`  // Return the fans to the driver's temperature-based control
+}
+
+// Fan state of a GPU
+type FanInfo struct {
+	Index     int        `json:"index"`
+	Fans      []FanState `json:"fans"`
+	MinSpeed  int        `json:"minSpeed,omitempty"` // Lowest speed in percent that can be set
+	MaxSpeed  int        `json:"maxSpeed,omitempty"` // Highest speed in percent that can be set
+	Supported bool       `json:"supported"`          // Whether the fans can be controlled, not on passively cooled cards
+}
+
+// State of one fan
+type FanState struct {
+	Fan    int    `json:"fan"`
+	Speed  uint32 `json:"speed"`  // Target speed in percent
+	Manual bool   `json:"manual"` // Whether the speed is fixed rather than temperature-based
+}
+
+// Pending changes on a GPU that only take effect after a reboot
+type PendingRebootInfo struct {
+	Index          int      `json:"index"`
+	RebootRequired bool     `json:"rebootRequired"`
+	Reasons        []string `json:"reasons"`
+}
+
+// Supported clock combinations of a GPU
+type SupportedClocksInfo struct {
+	Index        int                    `json:"index"`
+	MemoryClocks []SupportedMemoryClock `json:"memoryClocks"` // Highest memory clock first
+	Supported    bool                   `json:"supported"`    // Whether NVML reports supported clocks
+}
+
+// Current clocks of a GPU's engines
+type ClocksInfo struct {
+	Index  int          `json:"index"`
+	SM     ClockReading `json:"sm"`
+	Memory ClockReading `json:"memory"`
+	Video  ClockReading `json:"video"`
+}
+
+// Clocks of one engine in MHz, 0 where the GPU doesn't report them
+type ClockReading struct {
+	Current     uint32 `json:"current"`     // Clock the engine runs at now
+	Max         uint32 `json:"max"`         // Highest clock the engine can run at
+	Application uint32 `json:"application"` // Clock set for applications, which boosting can exceed
+}
+
+// Memory clock with the graphics clocks that can be used with it
+type SupportedMemoryClock struct {
+	MemoryClock    uint32   `json:"memoryClock"`    // Memory clock in MHz
+	GraphicsClocks []uint32 `json:"graphicsClocks"` // Graphics clocks in MHz, highest first
+}
+
+// Errors returned by GPU operations, wrapped with details. Use errors.Is to check for them.
+var (
+	ErrPowerMgmtUnsupported = errors.New("power management not supported")
+	ErrOutOfRange           = errors.New("out of range")
+	ErrNVML                 = errors.New("NVML error")
+	ErrNotVisible           = errors.New("GPU not visible")
+	ErrNVMLUnhealthy        = errors.New("NVML unhealthy")
+	ErrCooldown             = errors.New("changed too recently")
+	ErrDriverTooOld         = errors.New("driver too old for this operation")
+	ErrNotSupported         = errors.New("not supported")
+)
+
+// Error for a limit change that arrived within setCooldownMs of the previous one
+type cooldownError struct {
+	index    int
+	cooldown time.Duration
+	retryIn  time.Duration
+}
+
+func (e *cooldownError) Error() string {
+	return fmt.Sprintf("%v: GPU %d limit changed less than %v ago, retry in %v",
+		ErrCooldown, e.index, e.cooldown, e.retryIn.Round(time.Millisecond))
+}
+
+func (e *cooldownError) Unwrap() error {
+	return ErrCooldown
+}
+
+// GPU indices this process may read or modify, from NVIDIA_POWER_VISIBLE (nil = all GPUs)
+var visibleGPUs map[int]bool
+
+// Site policy ceiling in watts from config.json (0 = no ceiling)
+var policyMaxWatts uint32
+
+// Whether power usage is read from sysfs when NVML doesn't report it, from config.json
+var sysfsFallback bool
+
+// Whether limits below the NVML minimum are passed to NVML as is, from --unsafe-allow-below-min
+var allowBelowMin bool
+
+// Whether set requests are strict or dry runs unless they say otherwise, from config.json
+var defaultStrict bool
+var defaultDryRun bool
+
+// Get the apply options for a change, where set request fields override the config defaults
+func resolveApplyOptions(source string, strict, dryRun *bool) applyOptions {
+	opts := applyOptions{source: source, strict: defaultStrict, dryRun: defaultDryRun}
+	if strict != nil {
+		opts.strict = *strict
+	}
+	if dryRun != nil {
+		opts.dryRun = *dryRun
+	}
+	return opts
+}
+
+// Clamp policies a set request can choose instead of strict:
+//
+//	clamp          raise limits below the minimum and lower limits above the maximum (strict: false)
+//	reject         fail on limits outside the allowed range (strict: true)
+//	rejectLowOnly  fail on limits below the minimum, which are likely typos, but lower limits above the maximum
+var clampPolicies = []string{"clamp", "reject", "rejectLowOnly"}
+
+// Check that a clamp policy is one of clampPolicies or empty
+func validateClampPolicy(policy string) error {
+	if policy == "" || slices.Contains(clampPolicies, policy) {
+		return nil
+	}
+	return fmt.Errorf("invalid clampPolicy: %s (must be 'clamp', 'reject' or 'rejectLowOnly')", policy)
+}
+
+// Get the apply options for a set request, with its clamp policy taking precedence over strict
+func resolveRequestOptions(strict, dryRun *bool, clampPolicy string) applyOptions {
+	opts := resolveApplyOptions("api", strict, dryRun)
+	switch clampPolicy {
+	case "clamp":
+		opts.strict = false
+	case "reject":
+		opts.strict = true
+	case "rejectLowOnly":
+		opts.strict = false
+		opts.rejectLow = true
+	}
+	return opts
+}
+
+// How often clamped limits are logged: "always" (default), "once" per GPU and limit, or "off"
+var clampLogging string
+
+// Field name casing of GPU information in responses: "camel" (default) or "snake"
+var jsonCase string
+
+// Fraction of set operations that fail on purpose, from failRate with --test-mode (0 = never)
+var failRate float64
+
+// Group name of each grouped GPU index, from config.json
+var gpuGroups map[int]string
+
+// Labels of each GPU index, from gpuLabels in config.json
+var gpuLabels map[int]map[string]string
+
+// Power limit change made by this process
+type LimitChange struct {
+	Timestamp time.Time `json:"timestamp"`
+	OldLimit  uint32    `json:"oldLimit"` // Previous power limit in watts
+	NewLimit  uint32    `json:"newLimit"` // New power limit in watts
+	Source    string    `json:"source"`   // What made the change: "cli", "config", "api", "reset", "enforce", "restore", "rollback", "demand-response" or "external-meter"
+}
+
+// Power limit change in the audit log, across all GPUs
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"` // Position in the audit log, increasing by one per change, for paging
+	Timestamp time.Time `json:"timestamp"`
+	Index     int       `json:"index"`
+	OldLimit  uint32    `json:"oldLimit"` // Previous power limit in watts
+	NewLimit  uint32    `json:"newLimit"` // New power limit in watts
+	Source    string    `json:"source"`   // What made the change, as in LimitChange
+}
+
+// GPU event reported by NVML
+type GPUEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Index     int       `json:"index"`
+	Type      string    `json:"type"` // "xid", "pstate", "clock", "eccSingleBit", "eccDoubleBit" or "powerSource"
+	Data      uint64    `json:"data"` // XID number for "xid" events
+}
+
+// Maximum number of recent events kept
+const maxRecentEvents = 100
+
+// Most recent GPU events, oldest first
+var recentEvents []GPUEvent
+var recentEventsMutex sync.Mutex
+
+// Maximum number of changes kept per GPU
+const maxChangesPerGPU = 100
+
+// Maximum number of entries kept in the audit log, and returned by one GET /api/audit
+const maxAuditEntries = 1000
+const defaultAuditLimit = 100
+
+// Last power limit this process applied to each GPU, for drift monitoring
+var lastApplied = make(map[int]uint32)
+var lastAppliedMutex sync.Mutex
+
+// Minimum time between limit changes on the same GPU, from setCooldownMs (0 = no minimum)
+var setCooldown time.Duration
+
+// Wait after setting a limit before reading it back, from settleDelayMs (0 = none)
+var settleDelay time.Duration
+
+// When each GPU's limit was last changed, for setCooldown
+var lastSetTimes = make(map[int]time.Time)
+var lastSetTimesMutex sync.Mutex
+
+// Per GPU log of power limit changes since the process started
+var changeLog = make(map[int][]LimitChange)
+var changeLogMutex sync.Mutex
+
+// Power limit changes of all GPUs, oldest first, also guarded by changeLogMutex
+var auditLog []AuditEntry
+
+// Sequence number of the last audit entry, also guarded by changeLogMutex
+var auditSeq uint64
+
+// Broadcast whenever a change is recorded, for long-polling clients
+var changeCond = sync.NewCond(&changeLogMutex)
+
+// Default and maximum time a long-poll request waits for a change
+const defaultLongPollTimeout = 30 * time.Second
+const maxLongPollTimeout = 5 * time.Minute
+
+// Web dashboard assets
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Global variables for API access
+var gpuCache []GPUInfo
+var gpuCacheUpdated time.Time
+var gpuCacheMutex sync.Mutex
+var config Config
+
+// Default time to remember responses for an Idempotency-Key
+const defaultIdempotencyTTL = 10 * time.Minute
+
+// Returned by loadConfig when there is no config file to load
+var errNoConfigFile = errors.New("no config.json found")
+
+// Port for the API server when none is configured
+const defaultAPIPort = 8080
+
+// NVML initialization limits
+const (
+	nvmlInitTimeout    = 30 * time.Second
+	nvmlInitAttempts   = 3
+	nvmlInitRetryDelay = 2 * time.Second
+)
+
+// Default time between re-applying limits in enforce-only mode
+const defaultEnforceInterval = 30 * time.Second
+
+// Default time between externalMeterCmd runs, and the smallest change in the
+// GPU budget that is applied
+const defaultExternalMeterInterval = 10 * time.Second
+const externalMeterDeadband = 10
+
+// Time between attempts with retryApplyUntilComplete
+const applyRetryInterval = 5 * time.Second
+
+// Defaults of applyWhenIdle, and how often GPU utilization is checked while waiting
+const defaultIdleUtilization = 10
+const defaultIdleMaxWait = 10 * time.Minute
+const idlePollInterval = 10 * time.Second
+
+// Default consecutive NVML failures before calls are paused, and for how long
+const defaultNVMLFailureThreshold = 5
+const defaultNVMLCooldown = 30 * time.Second
+
+// Default API server timeouts
+const defaultReadTimeout = 10 * time.Second
+const defaultWriteTimeout = 30 * time.Second
+const defaultIdleTimeout = 2 * time.Minute
+
+// Default time finished async jobs are kept
+const defaultJobTTL = 10 * time.Minute
+
+// Default time between --watch redraws
+const defaultWatchInterval = 2 * time.Second
+
+// Default time between --log-csv rows
+const defaultCSVInterval = 5 * time.Second
+
+// Default time between StatsD updates
+const defaultStatsdInterval = 10 * time.Second
+
+// Default prefix of StatsD metric names
+const defaultStatsdPrefix = "nvidia_power"
+
+// Default time between /api/stream updates
+const defaultStreamInterval = time.Second
+
+// Response stored for an Idempotency-Key
+type idempotentResponse struct {
+	requestHash [sha256.Size]byte // Hash of the request body the key was first used with
+	done        bool              // False while the original request is still in flight
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var idempotencyKeys = make(map[string]*idempotentResponse)
+var idempotencyMutex sync.Mutex
+
+// API keys accepted by the server, managed at runtime through /api/keys
+var apiKeys []APIKeyEntry
+var apiKeysMutex sync.RWMutex
+
+// Labels of the API keys that came from the config, so a reload can tell them
+// apart from keys added through /api/keys
+var configAPIKeyLabels map[string]bool
+
+// Path of the config file, or an http(s):// URL to fetch it from
+var configPath = "config.json"
+
+// API key and port from --api-key and --api-port, which override the config and
+// the environment in every mode and on reload (empty/0 = not given)
+var apiKeyOverride string
+var apiPortOverride int
+
+// Time allowed for fetching a remote config
+const remoteConfigTimeout = 10 * time.Second
+
+// Last config fetched successfully from a URL, used when the URL is unreachable
+var lastRemoteConfig []byte
+var lastRemoteConfigMutex sync.Mutex
+
+// Context key for the API key that authenticated a request
+type apiKeyContextKey struct{}
+
+// Annotated config.json printed by --help, also the source of the config
+// field descriptions in --help-json
+const configHelp = `  {
+    "mode": "all",                   // "all", "manual" or "headroom"
+    "powerLimit": 250,               // Power limit in watts for "all" mode
+    "powerLimitPercent": 80,         // Optional, power limit in percent for "all" mode (overrides powerLimit)
+    "percentOf": "max",              // Optional, percentages relative to "max" (default) or "default" limit
+    "headroomWatts": 20,             // For "headroom" mode: limit = current usage + this, clamped.
+                                     // Usage is sampled once per apply, so an idle moment gives a tight cap
+    "groups": {                      // Optional, named GPU sets limited together via POST /api/groups/{name}/power
+      "training": {"indices": [0, 1, 2, 3], "powerLimit": 300},  // powerLimit is applied with the config, 0 = none
+      "inference": {"indices": [4, 5, 6, 7], "powerLimit": 200}
+    },
+    "gpuLabels": {                   // Optional, labels per GPU index, shown in GPU info and added to /metrics series
+      "0": {"role": "training"}      // Label names must be valid Prometheus names other than gpu and name
+    },
+    "sysfsFallback": false,          // Optional, Linux only: read power usage from sysfs hwmon if NVML can't
+    "defaultStrict": false,          // Optional, fail instead of clamping out-of-range limits (request "strict" / --strict override)
+    "defaultDryRun": false,          // Optional, only report limits (request "dryRun" / --dry-run override)
+    "retryApplyUntilComplete": "2m", // Optional, retry GPUs that failed to apply (e.g. not ready at boot) for up to this long
+    "atomicApply": false,            // Optional, undo all changes and exit if any GPU fails to apply
+    "applyWhenIdle": {               // Optional, wait to apply a reloaded config (watchConfig) until every GPU is idle
+      "utilization": 10,             // Every GPU below this utilization percentage counts as idle
+      "maxWait": "10m"               // Apply anyway after waiting this long
+    },
+    "disabledOperations": [],        // Optional, API operations to refuse: "power", "lockedClocks", "autoBoost", "fan", "keys"
+    "clampLogging": "always",        // Optional, log clamped limits "always", "once" per GPU and limit, or "off"
+    "jsonCase": "camel",             // Optional, GPU field names in responses: "camel" (default) or "snake" (the dashboard needs camel)
+    "policyMaxWatts": 0,             // Optional, never set a limit above this many watts (also from the command line)
+    "manualLimits": {                // For "manual" mode
+      "0": 220,                      // GPU index : power limit in watts
+      "1": 180
+    },
+    "gpuLimits": [                   // Optional, "manual" mode limits as a list, replaces manualLimits when set
+      {"index": 0, "watts": 220},
+      {"index": 1, "watts": 180}
+    ],
+    "apiKey": "your-secure-api-key", // Required for API server (admin key labeled "default")
+    "apiKeys": [                     // Optional, additional labeled keys
+      {"label": "ops", "key": "another-key", "admin": false},
+      {"label": "monitoring", "key": "scrape-key", "readOnly": true}, // GET requests only
+      {"label": "scheduler", "key": "job-key", "allowedPaths": ["/api/power"]}  // Only these path prefixes, /api/info and its own /api/jobs
+    ],
+    "persistAPIKeys": false,         // Optional, write keys added/removed via /api/keys back to config.json
+    "apiPort": 8080,                 // Optional, defaults to 8080
+    "metricsMaxStaleness": "5s",     // Optional, reuse /metrics samples this fresh across scrapes (defaults to cacheTTL)
+    "cacheTTL": "500ms",             // Optional, serve GET requests from cached GPU data this fresh
+    "jobTTL": "10m",                 // Optional, how long results of {"async": true} requests stay at /api/jobs/{id}
+    "idempotencyTTL": "10m",         // Optional, how long Idempotency-Key responses are replayed
+    "streamInterval": "1s",          // Optional, time between /api/stream updates
+    "enforceInterval": "30s",        // Optional, re-apply limits this often (also alongside the API server)
+    "enforceOnly": false,            // Optional, keep re-applying limits without starting the API server
+    "monitorDrift": false,           // Optional, after applying, log limits changed by other processes (no correcting)
+    "driftInterval": "30s",          // Optional, how often to check for drift
+    "serveDashboard": false,         // Optional, serve a web dashboard at / (log in with the API key)
+    "monitorEvents": false,          // Optional, log XID/power state/clock events and list them at /api/events
+    "eventWebhookURL": "",           // Optional, POST each event as JSON to this URL
+    "maxConcurrentRequests": 0,      // Optional, in-flight API requests (reads and writes together) before 503, 0 = unlimited
+    "exposeMetrics": false,          // Optional, serve Prometheus metrics at /metrics (no API key needed)
+    "metricsUnits": "watts",         // Optional, power metric units: "watts" (default), "milliwatts" or "both"
+    "tlsCertFile": "",               // Optional, serve HTTPS with this certificate; HTTP/2 is then used automatically
+    "tlsKeyFile": "",                // Optional, private key for tlsCertFile
+    "http2Cleartext": false,         // Optional, accept HTTP/2 over plain HTTP (h2c with prior knowledge)
+    "readTimeout": "10s",            // Optional, maximum time to read a request
+    "writeTimeout": "30s",           // Optional, maximum time to write a response (/api/stream is exempt)
+    "idleTimeout": "2m",             // Optional, how long idle keep-alive connections stay open
+    "setCooldownMs": 0,              // Optional, reject changes to a GPU within this many ms of the last one (API answers 429)
+    "settleDelayMs": 0,              // Optional, wait this long after a set before reading the limit back, for drivers that lag
+    "nvmlFailureThreshold": 5,       // Optional, consecutive NVML failures before calls pause (API answers 503)
+    "nvmlCooldown": "30s",           // Optional, how long to pause before probing NVML again
+    "statsdAddr": "",                // Optional, send power usage/limit/temperature gauges to this StatsD host:port over UDP
+    "statsdPrefix": "nvidia_power",  // Optional, StatsD metric name prefix
+    "statsdInterval": "10s",         // Optional, time between StatsD updates
+    "watchConfig": false,            // Optional, reload and re-apply config.json when the file changes
+    "demandResponseFile": "",        // Optional, file with a total wattage (e.g. 1500 or 1.5kW) split across the GPUs when it changes
+    "externalMeterCmd": "",          // Optional, shell command printing the facility power draw in watts
+    "externalMeterBudget": 0,        // Facility watts above which the excess is taken off the GPUs (needs externalMeterCmd)
+    "externalMeterInterval": "10s",  // Optional, time between externalMeterCmd runs
+    "startAPIServer": true           // Whether to start the API server (true/false)
+  }`
+
+// Print help information
+func printHelp() {
+	fmt.Println("NVIDIA Power Control - Manage power limits for NVIDIA GPUs")
+	fmt.Println("\nUsage:")
+	fmt.Println("  Set power limit for all GPUs:")
+	fmt.Println("    nvidia-power-control <power_limit_in_watts>   (200, 200W or 0.2kW)")
+	fmt.Println("\n  Set power limit for specific GPUs:")
+	fmt.Println("    nvidia-power-control --gpu=0:<power_limit> --gpu=1:<power_limit> ...")
+	fmt.Println("\n  Set power limit as a percentage (of the maximum limit by default):")
+	fmt.Println("    nvidia-power-control <percent>% [--percent-of=max|default]")
+	fmt.Println("    nvidia-power-control --gpu=0:<percent>% ...")
+	fmt.Println("    --percent-of=max      percentages are relative to the highest limit the card allows")
+	fmt.Println("    --percent-of=default  percentages are relative to the card's default limit (stock TDP)")
+	fmt.Println("\n  Only apply to GPUs whose load (utilization or power usage, in percent) is at least a threshold:")
+	fmt.Println("    nvidia-power-control --busy-threshold=<percent> <power_limit_in_watts>")
+	fmt.Println("\n  Leave GPUs with running compute processes untouched:")
+	fmt.Println("    nvidia-power-control --skip-busy <power_limit_in_watts>")
+	fmt.Println("\n  Run in API server mode (requires config.json):")
+	fmt.Println("    nvidia-power-control [--api-key=<key>] [--api-port=<port>]")
+	fmt.Println("\n  Run only the API server, leaving all limits to API calls (config.json optional):")
+	fmt.Println("    nvidia-power-control --server-only [--api-key=<key>] [--api-port=<port>]")
+	fmt.Println("\n  List GPUs with their power usage and limits:")
+	fmt.Println("    nvidia-power-control --list")
+	fmt.Println("    nvidia-power-control --watch [--interval=<seconds>]   redraw every 2 seconds until Ctrl-C")
+	fmt.Println("\n  Append power usage, limit and temperature of each GPU to a CSV file every 5 seconds until Ctrl-C:")
+	fmt.Println("    nvidia-power-control --log-csv=<path> [--interval=<seconds>]")
+	fmt.Println("\n  Measure NVML read and set latency on each GPU (limits are restored afterwards):")
+	fmt.Println("    nvidia-power-control --bench [--iterations=<n>]")
+	fmt.Println("\n  Use a config file other than ./config.json:")
+	fmt.Println("    nvidia-power-control --config=/etc/nvidia-power-control/config.json")
+	fmt.Println("    nvidia-power-control --config=https://config.example.com/gpu.json   (token from NVIDIA_POWER_CONFIG_TOKEN)")
+	fmt.Println("\n  Show this help:")
+	fmt.Println("    nvidia-power-control -h | --help")
+	fmt.Println("    nvidia-power-control --help-json   options and config fields as JSON")
+	fmt.Println("\n  Print a config.json that recreates the current power limits:")
+	fmt.Println("    nvidia-power-control --dump-config > config.json")
+	fmt.Println("\n  Send log output to syslog/journald instead of stdout:")
+	fmt.Println("    nvidia-power-control --log-to=syslog")
+	fmt.Println("\n  Print the effective config after merging config.json, NVIDIA_POWER_* variables and options:")
+	fmt.Println("    nvidia-power-control --print-config [--config=<path>]")
+	fmt.Println("\n  Apply config.json, then keep re-applying it without the API server:")
+	fmt.Println("    nvidia-power-control --enforce-only")
+	fmt.Println("\n  Put the original limits back on Ctrl-C or SIGTERM (waits after a one-off change):")
+	fmt.Println("    nvidia-power-control --restore-on-exit <power_limit_in_watts>")
+	fmt.Println("\n  Send limits below the reported minimum to NVML instead of clamping (risky, lab use only):")
+	fmt.Println("    nvidia-power-control --unsafe-allow-below-min <power_limit_in_watts>")
+	fmt.Println("\n  Fail instead of clamping out-of-range limits, or only show what would be set:")
+	fmt.Println("    nvidia-power-control --strict <power_limit_in_watts>")
+	fmt.Println("    nvidia-power-control --dry-run <power_limit_in_watts>")
+	fmt.Println("    Defaults come from defaultStrict/defaultDryRun in config.json; the flags (or the")
+	fmt.Println("    \"strict\"/\"dryRun\" fields of an API request) take precedence, e.g. --dry-run=false")
+	fmt.Println("\nExamples:")
+	fmt.Println("  Set all GPUs to 200 watts:")
+	fmt.Println("    nvidia-power-control 200")
+	fmt.Println("\n  Set GPU 0 to 200 watts and GPU 1 to 180 watts:")
+	fmt.Println("    nvidia-power-control --gpu=0:200 --gpu=1:180")
+	fmt.Println("\n  Throttle only GPUs that are at least 50% busy to 150 watts:")
+	fmt.Println("    nvidia-power-control --busy-threshold=50 150")
+	fmt.Println("\nEnvironment:")
+	fmt.Println("  NVIDIA_POWER_VISIBLE=0,2  Only read or modify the listed GPU indices")
+	fmt.Println("  NVIDIA_POWER_MODE, NVIDIA_POWER_LIMIT, NVIDIA_POWER_API_KEY, NVIDIA_POWER_API_PORT,")
+	fmt.Println("  NVIDIA_POWER_START_API_SERVER  Override the matching config.json fields. With")
+	fmt.Println("  NVIDIA_POWER_START_API_SERVER set the API server starts even without a config.json")
+	fmt.Println("\nConfig.json format (for API server mode):")
+	fmt.Println(configHelp)
+}
+
+// Command line option description in --help-json
+type FlagHelp struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     string `json:"default,omitempty"`
+}
+
+// Config field description in --help-json
+type ConfigFieldHelp struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // JSON type: "string", "number", "boolean", "object" or "array"
+	Description string `json:"description,omitempty"`
+}
+
+// Machine-readable usage printed by --help-json
+type HelpDocument struct {
+	Flags  []FlagHelp        `json:"flags"`
+	Config []ConfigFieldHelp `json:"config"`
+}
+
+// Get the JSON type a config field is written as
+func jsonTypeName(t reflect.Type) string {
+	if t == reflect.TypeOf(Duration(0)) {
+		return "string" // Written as "500ms"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+// Print the command line options and config fields as JSON, with the config
+// field descriptions taken from the comments in configHelp
+func printHelpJSON(flags *flag.FlagSet) error {
+	doc := HelpDocument{Flags: []FlagHelp{}, Config: []ConfigFieldHelp{}}
+	flags.VisitAll(func(f *flag.Flag) {
+		doc.Flags = append(doc.Flags, FlagHelp{Name: f.Name, Description: f.Usage, Default: f.DefValue})
+	})
+
+	descriptions := make(map[string]string)
+	line := regexp.MustCompile(`^\s*"(\w+)":.*?//\s*(.*)$`)
+	for _, text := range strings.Split(configHelp, "\n") {
+		if match := line.FindStringSubmatch(text); match != nil {
+			if _, seen := descriptions[match[1]]; !seen {
+				descriptions[match[1]] = match[2]
+			}
+		}
+	}
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		doc.Config = append(doc.Config, ConfigFieldHelp{
+			Name:        name,
+			Type:        jsonTypeName(field.Type),
+			Description: descriptions[name],
+		})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// Wrap a failed NVML call so callers can detect it with errors.Is(err, ErrNVML),
+// or ErrNVMLUnhealthy while the circuit breaker holds NVML calls back
+func nvmlError(action string, ret nvml.Return) error {
+	if open, retryIn := nvmlBreaker.state(); open {
+		return fmt.Errorf("%w: failed to %s: NVML calls paused after repeated failures, retrying in %v",
+			ErrNVMLUnhealthy, action, retryIn.Round(time.Second))
+	}
+	return &nvmlCallError{action: action, ret: ret}
+}
+
+// Failed NVML call, keeping the return code for error responses
+type nvmlCallError struct {
+	action string
+	ret    nvml.Return
 }
 
-// Power limit update request
-type PowerLimitRequest struct {
-	Mode         string         `json:"mode"`         // "all" or "manual"
-	PowerLimit   uint32         `json:"powerLimit"`   // Power limit for all GPUs in watts
-	ManualLimits map[int]uint32 `json:"manualLimits"` // GPU index to power limit map
+func (e *nvmlCallError) Error() string {
+	if e.ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		return fmt.Sprintf("%v: failed to %s: the installed NVIDIA driver doesn't provide it", ErrDriverTooOld, e.action)
+	}
+	return fmt.Sprintf("%v: failed to %s: %v", ErrNVML, e.action, nvml.ErrorString(e.ret))
+}
+
+func (e *nvmlCallError) Unwrap() error {
+	if e.ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		return ErrDriverTooOld
+	}
+	return ErrNVML
+}
+
+// Names of NVML return codes as in nvml.h, without the NVML_ prefix. A loaded
+// NVML library only gives descriptions through nvml.ErrorString.
+var nvmlReturnNames = map[nvml.Return]string{
+	nvml.SUCCESS:                         "SUCCESS",
+	nvml.ERROR_UNINITIALIZED:             "ERROR_UNINITIALIZED",
+	nvml.ERROR_INVALID_ARGUMENT:          "ERROR_INVALID_ARGUMENT",
+	nvml.ERROR_NOT_SUPPORTED:             "ERROR_NOT_SUPPORTED",
+	nvml.ERROR_NO_PERMISSION:             "ERROR_NO_PERMISSION",
+	nvml.ERROR_ALREADY_INITIALIZED:       "ERROR_ALREADY_INITIALIZED",
+	nvml.ERROR_NOT_FOUND:                 "ERROR_NOT_FOUND",
+	nvml.ERROR_INSUFFICIENT_SIZE:         "ERROR_INSUFFICIENT_SIZE",
+	nvml.ERROR_INSUFFICIENT_POWER:        "ERROR_INSUFFICIENT_POWER",
+	nvml.ERROR_DRIVER_NOT_LOADED:         "ERROR_DRIVER_NOT_LOADED",
+	nvml.ERROR_TIMEOUT:                   "ERROR_TIMEOUT",
+	nvml.ERROR_IRQ_ISSUE:                 "ERROR_IRQ_ISSUE",
+	nvml.ERROR_LIBRARY_NOT_FOUND:         "ERROR_LIBRARY_NOT_FOUND",
+	nvml.ERROR_FUNCTION_NOT_FOUND:        "ERROR_FUNCTION_NOT_FOUND",
+	nvml.ERROR_CORRUPTED_INFOROM:         "ERROR_CORRUPTED_INFOROM",
+	nvml.ERROR_GPU_IS_LOST:               "ERROR_GPU_IS_LOST",
+	nvml.ERROR_RESET_REQUIRED:            "ERROR_RESET_REQUIRED",
+	nvml.ERROR_OPERATING_SYSTEM:          "ERROR_OPERATING_SYSTEM",
+	nvml.ERROR_LIB_RM_VERSION_MISMATCH:   "ERROR_LIB_RM_VERSION_MISMATCH",
+	nvml.ERROR_IN_USE:                    "ERROR_IN_USE",
+	nvml.ERROR_MEMORY:                    "ERROR_MEMORY",
+	nvml.ERROR_NO_DATA:                   "ERROR_NO_DATA",
+	nvml.ERROR_VGPU_ECC_NOT_SUPPORTED:    "ERROR_VGPU_ECC_NOT_SUPPORTED",
+	nvml.ERROR_INSUFFICIENT_RESOURCES:    "ERROR_INSUFFICIENT_RESOURCES",
+	nvml.ERROR_FREQ_NOT_SUPPORTED:        "ERROR_FREQ_NOT_SUPPORTED",
+	nvml.ERROR_ARGUMENT_VERSION_MISMATCH: "ERROR_ARGUMENT_VERSION_MISMATCH",
+	nvml.ERROR_DEPRECATED:                "ERROR_DEPRECATED",
+	nvml.ERROR_NOT_READY:                 "ERROR_NOT_READY",
+	nvml.ERROR_GPU_NOT_FOUND:             "ERROR_GPU_NOT_FOUND",
+	nvml.ERROR_INVALID_STATE:             "ERROR_INVALID_STATE",
+	nvml.ERROR_UNKNOWN:                   "ERROR_UNKNOWN",
+}
+
+// Circuit breaker that stops NVML calls for a cooldown after repeated failures,
+// so a hanging driver isn't hammered further. After the cooldown the next
+// call is let through as a probe: success closes the breaker, failure reopens it.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+var nvmlBreaker = &circuitBreaker{threshold: defaultNVMLFailureThreshold, cooldown: defaultNVMLCooldown}
+
+// Check whether calls are held back, and for how long
+func (b *circuitBreaker) state() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	retryIn := time.Until(b.openUntil)
+	return retryIn > 0, retryIn
+}
+
+// Record the result of a call
+func (b *circuitBreaker) record(ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if ok {
+		if b.failures >= b.threshold {
+			logInfo("NVML recovered, resuming calls")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		logWarning("NVML failed %d times in a row, pausing calls for %v", b.failures, b.cooldown)
+	}
+}
+
+// Whether an NVML result points at a driver problem rather than a bad argument
+func isNVMLFailure(ret nvml.Return) bool {
+	return ret != nvml.SUCCESS && ret != nvml.ERROR_INVALID_ARGUMENT && ret != nvml.ERROR_NOT_FOUND &&
+		ret != nvml.ERROR_FUNCTION_NOT_FOUND
+}
+
+// Get the number of GPUs through the circuit breaker
+func deviceCount() (int, nvml.Return) {
+	if open, _ := nvmlBreaker.state(); open {
+		return 0, nvml.ERROR_UNKNOWN
+	}
+	count, ret := nvml.DeviceGetCount()
+	nvmlBreaker.record(!isNVMLFailure(ret))
+	return count, ret
+}
+
+// Get a GPU handle through the circuit breaker
+func deviceHandle(index int) (nvml.Device, nvml.Return) {
+	if open, _ := nvmlBreaker.state(); open {
+		return nil, nvml.ERROR_UNKNOWN
+	}
+	device, ret := nvml.DeviceGetHandleByIndex(index)
+	nvmlBreaker.record(!isNVMLFailure(ret))
+	return device, ret
+}
+
+// API middleware that answers 503 while the NVML circuit breaker is open
+func nvmlHealthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if open, retryIn := nvmlBreaker.state(); open {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryIn.Seconds())+1))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("NVML unhealthy, retrying in %v", retryIn.Round(time.Second))})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Get the HTTP status code matching an error from a GPU operation
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrPowerMgmtUnsupported), errors.Is(err, ErrNotSupported):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrOutOfRange):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotVisible):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNVMLUnhealthy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrCooldown):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrDriverTooOld):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Write an error response with the status code matching the error
+func writeError(w http.ResponseWriter, err error) {
+	var cooldown *cooldownError
+	if errors.As(err, &cooldown) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cooldown.retryIn.Seconds())+1))
+	}
+	w.WriteHeader(statusForError(err))
+	json.NewEncoder(w).Encode(errorBody(err))
+}
+
+// Write an error response for an optional GPU feature, saying whether the GPU supports it
+func writeFeatureError(w http.ResponseWriter, err error, supported bool) {
+	w.WriteHeader(statusForError(err))
+	body := errorBody(err)
+	body["supported"] = supported
+	json.NewEncoder(w).Encode(body)
+}
+
+// Get the JSON body of an error response. Failed NVML calls add the return
+// code as nvmlCode and nvmlName, so clients can tell NOT_SUPPORTED from GPU_IS_LOST.
+func errorBody(err error) map[string]interface{} {
+	body := map[string]interface{}{"error": err.Error()}
+	var nvmlErr *nvmlCallError
+	if errors.As(err, &nvmlErr) {
+		body["nvmlCode"] = int(nvmlErr.ret)
+		if name, ok := nvmlReturnNames[nvmlErr.ret]; ok {
+			body["nvmlName"] = name
+		}
+	}
+	return body
+}
+
+// Parse a comma separated list of visible GPU indices such as "0,2".
+// An empty value or "all" makes every GPU visible.
+func parseVisibleGPUs(value string) (map[int]bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "all" {
+		return nil, nil
+	}
+
+	visible := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid GPU index in NVIDIA_POWER_VISIBLE: %q", part)
+		}
+		visible[index] = true
+	}
+	return visible, nil
+}
+
+// Check whether a GPU may be read or modified by this process
+func isGPUVisible(index int) bool {
+	return visibleGPUs == nil || visibleGPUs[index]
+}
+
+// Initialize the NVML library. Called exactly once at startup; a driver that
+// hangs is given up on after nvmlInitTimeout, failures are retried.
+func initNVML() error {
+	var ret nvml.Return
+	for attempt := 1; attempt <= nvmlInitAttempts; attempt++ {
+		done := make(chan nvml.Return, 1)
+		go func() {
+			done <- nvml.Init()
+		}()
+
+		select {
+		case ret = <-done:
+		case <-time.After(nvmlInitTimeout):
+			return fmt.Errorf("%w: NVML initialization timed out after %v", ErrNVML, nvmlInitTimeout)
+		}
+
+		if ret == nvml.SUCCESS {
+			logInfo("NVML initialized (attempt %d/%d)", attempt, nvmlInitAttempts)
+			return nil
+		}
+
+		logWarning("NVML initialization attempt %d/%d failed: %v", attempt, nvmlInitAttempts, nvml.ErrorString(ret))
+		if attempt < nvmlInitAttempts {
+			time.Sleep(nvmlInitRetryDelay)
+		}
+	}
+	return nvmlError("initialize NVML", ret)
+}
+
+// Rebuild the GPU cache with fresh information from NVML
+func refreshGPUCache() error {
+	// Get number of GPUs
+	count, ret := deviceCount()
+	if ret != nvml.SUCCESS {
+		return nvmlError("get device count", ret)
+	}
+
+	// Collect fresh GPU information for the visible GPUs
+	gpus := make([]GPUInfo, 0, count)
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			logWarning("Warning: Failed to get info for GPU %d: %v", i, err)
+		}
+		gpus = append(gpus, gpuInfo)
+	}
+
+	// Replace the GPU cache
+	gpuCacheMutex.Lock()
+	gpuCache = gpus
+	gpuCacheUpdated = time.Now()
+	gpuCacheMutex.Unlock()
+
+	return nil
+}
+
+// Get information for all GPUs, serving the cache while it is younger than the
+// configured TTL. Returns whether the result came from the cache.
+func getCachedGPUs() ([]GPUInfo, bool, error) {
+	ttl := time.Duration(currentConfig().CacheTTL)
+
+	gpuCacheMutex.Lock()
+	if ttl > 0 && gpuCache != nil && time.Since(gpuCacheUpdated) < ttl {
+		gpus := append([]GPUInfo(nil), gpuCache...)
+		gpuCacheMutex.Unlock()
+		return gpus, true, nil
+	}
+	gpuCacheMutex.Unlock()
+
+	// Cache is stale or disabled - rebuild it
+	if err := refreshGPUCache(); err != nil {
+		return nil, false, err
+	}
+
+	gpuCacheMutex.Lock()
+	defer gpuCacheMutex.Unlock()
+	return append([]GPUInfo(nil), gpuCache...), false, nil
+}
+
+// Get information for one GPU, serving the cache while it is younger than the
+// configured TTL and otherwise reading just that GPU. Returns whether the result
+// came from the cache.
+func getCachedGPU(index int) (GPUInfo, bool, error) {
+	ttl := time.Duration(currentConfig().CacheTTL)
+
+	gpuCacheMutex.Lock()
+	if ttl > 0 && time.Since(gpuCacheUpdated) < ttl {
+		for _, gpuInfo := range gpuCache {
+			if gpuInfo.Index == index {
+				gpuCacheMutex.Unlock()
+				return gpuInfo, true, nil
+			}
+		}
+	}
+	gpuCacheMutex.Unlock()
+
+	gpuInfo, err := getGPUInfo(index)
+	if err != nil {
+		return gpuInfo, false, err
+	}
+
+	// Keep the cached entry current without marking the whole cache fresh
+	gpuCacheMutex.Lock()
+	for i := range gpuCache {
+		if gpuCache[i].Index == index {
+			gpuCache[i] = gpuInfo
+		}
+	}
+	gpuCacheMutex.Unlock()
+
+	return gpuInfo, false, nil
+}
+
+// Report whether a response was served from the GPU cache
+func setCacheHeader(w http.ResponseWriter, hit bool) {
+	if hit {
+		w.Header().Set("X-Cache", "hit")
+	} else {
+		w.Header().Set("X-Cache", "miss")
+	}
+}
+
+// Get information for a specific GPU
+func getGPUInfo(index int) (GPUInfo, error) {
+	var info GPUInfo
+	info.Index = index
+	configMutex.RLock()
+	info.Group = gpuGroups[index]
+	info.Labels = gpuLabels[index]
+	fallback := sysfsFallback
+	configMutex.RUnlock()
+
+	// Get device handle
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	// Get GPU name
+	name, ret := nvml.DeviceGetName(device)
+	if ret != nvml.SUCCESS {
+		name = "Unknown"
+	}
+	info.Name = name
+
+	// Get the UUID so clients can keep records that survive index changes
+	uuid, ret := nvml.DeviceGetUUID(device)
+	if ret == nvml.SUCCESS {
+		info.UUID = uuid
+	}
+
+	// Get memory usage
+	memory, ret := nvml.DeviceGetMemoryInfo(device)
+	if ret == nvml.SUCCESS {
+		info.MemoryTotalMB = memory.Total / (1024 * 1024) // Convert to MiB
+		info.MemoryUsedMB = memory.Used / (1024 * 1024)   // Convert to MiB
+	}
+
+	// Get current and pending ECC mode, which differ until a reboot
+	eccCurrent, eccPending, ret := nvml.DeviceGetEccMode(device)
+	if ret == nvml.SUCCESS {
+		info.EccCurrent = eccCurrent == nvml.FEATURE_ENABLED
+		info.EccPending = eccPending == nvml.FEATURE_ENABLED
+	}
+
+	// Get core temperature
+	temperature, ret := nvml.DeviceGetTemperature(device, nvml.TEMPERATURE_GPU)
+	if ret == nvml.SUCCESS {
+		info.Temperature = temperature
+	}
+
+	// Get the card's own slowdown and shutdown temperatures
+	slowdown, ret := nvml.DeviceGetTemperatureThreshold(device, nvml.TEMPERATURE_THRESHOLD_SLOWDOWN)
+	if ret == nvml.SUCCESS {
+		info.TempSlowdown = slowdown
+	}
+	shutdown, ret := nvml.DeviceGetTemperatureThreshold(device, nvml.TEMPERATURE_THRESHOLD_SHUTDOWN)
+	if ret == nvml.SUCCESS {
+		info.TempShutdown = shutdown
+	}
+
+	// Get serial number and VBIOS version, which NVML may not report (NOT_SUPPORTED)
+	serial, ret := nvml.DeviceGetSerial(device)
+	if ret == nvml.SUCCESS {
+		info.Serial = serial
+	}
+	vbios, ret := nvml.DeviceGetVbiosVersion(device)
+	if ret == nvml.SUCCESS {
+		info.VbiosVersion = vbios
+	}
+
+	// Get the performance state, P0 being the highest, or -1 if NVML doesn't know it
+	info.PerfState = -1
+	perfState, ret := nvml.DeviceGetPerformanceState(device)
+	if ret == nvml.SUCCESS && perfState != nvml.PSTATE_UNKNOWN {
+		info.PerfState = int(perfState)
+	}
+
+	// Get the current PCIe link, which power capping can downshift
+	pcieGen, ret := nvml.DeviceGetCurrPcieLinkGeneration(device)
+	if ret == nvml.SUCCESS {
+		info.PcieGen = pcieGen
+	}
+	pcieWidth, ret := nvml.DeviceGetCurrPcieLinkWidth(device)
+	if ret == nvml.SUCCESS {
+		info.PcieWidth = pcieWidth
+	}
+
+	// Get the Windows driver model, which Linux reports as NOT_SUPPORTED
+	driverModel, pendingModel, ret := nvml.DeviceGetDriverModel(device)
+	if ret == nvml.SUCCESS {
+		info.DriverModel = driverModelName(driverModel)
+		info.DriverModelPending = driverModelName(pendingModel)
+	}
+
+	// Get the active NVLink links, none on cards without NVLink
+	info.NvlinkLinks = getNvlinkStatus(device)
+	info.NvlinkActiveLinks = len(info.NvlinkLinks)
+
+	// Get auto-boost, which newer GPUs report as NOT_SUPPORTED
+	autoBoost, _, ret := nvml.DeviceGetAutoBoostedClocksEnabled(device)
+	if ret == nvml.SUCCESS {
+		info.AutoBoostSupported = true
+		info.AutoBoostEnabled = autoBoost == nvml.FEATURE_ENABLED
+	}
+
+	// Check if power management is supported, which a driver too old to tell can't do either
+	mode, ret := nvml.DeviceGetPowerManagementMode(device)
+	if ret == nvml.ERROR_FUNCTION_NOT_FOUND {
+		return info, nil
+	} else if ret != nvml.SUCCESS {
+		return info, nvmlError("get power management mode", ret)
+	}
+	info.Supported = (mode == nvml.FEATURE_ENABLED)
+
+	if !info.Supported {
+		return info, nil // Return early with limited info if not supported
+	}
+
+	// Get current power limit
+	currentLimit, ret := nvml.DeviceGetPowerManagementLimit(device)
+	if ret == nvml.SUCCESS {
+		info.PowerLimit = currentLimit / 1000 // Convert to watts
+	} else if ret != nvml.ERROR_FUNCTION_NOT_FOUND {
+		return info, nvmlError("get current power limit", ret)
+	}
+
+	// Get the enforced power limit, which other constraints may hold below the set limit
+	enforcedLimit, ret := nvml.DeviceGetEnforcedPowerLimit(device)
+	if ret == nvml.SUCCESS {
+		info.EnforcedLimit = enforcedLimit / 1000 // Convert to watts
+	}
+
+	// Get power limit constraints
+	minLimit, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
+	if ret == nvml.SUCCESS {
+		info.MinLimit = minLimit / 1000 // Convert to watts
+		info.MaxLimit = maxLimit / 1000 // Convert to watts
+	} else if ret != nvml.ERROR_FUNCTION_NOT_FOUND {
+		return info, nvmlError("get power limit constraints", ret)
+	}
+
+	// Get current power usage
+	power, ret := nvml.DeviceGetPowerUsage(device)
+	if ret == nvml.SUCCESS {
+		info.PowerUsage = power / 1000 // Convert to watts
+	} else if ret == nvml.ERROR_NOT_SUPPORTED && fallback {
+		if watts, err := readSysfsPowerUsage(device); err == nil {
+			info.PowerUsage = watts
+		}
+	}
+
+	info.PowerPercent = powerPercent(info.PowerUsage, info.PowerLimit)
+
+	// Get module power, only reported by some boards (SXM A100/H100)
+	if modulePower, ok := getModulePower(device); ok {
+		info.ModulePowerWatts = modulePower / 1000 // Convert to watts
+	}
+
+	// Get current utilization
+	utilization, ret := nvml.DeviceGetUtilizationRates(device)
+	if ret == nvml.SUCCESS {
+		info.Utilization = utilization.Gpu
+	}
+
+	return info, nil
+}
+
+// Collect the changes on a specific GPU that are waiting for a reboot
+func getPendingReboot(index int) (PendingRebootInfo, error) {
+	info := PendingRebootInfo{Index: index, Reasons: []string{}}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	// Each check is optional since not every GPU supports all of them
+	eccCurrent, eccPending, ret := nvml.DeviceGetEccMode(device)
+	if ret == nvml.SUCCESS && eccCurrent != eccPending {
+		info.Reasons = append(info.Reasons, "ECC mode change pending")
+	}
+
+	migCurrent, migPending, ret := nvml.DeviceGetMigMode(device)
+	if ret == nvml.SUCCESS && migCurrent != migPending {
+		info.Reasons = append(info.Reasons, "MIG mode change pending")
+	}
+
+	retiredPending, ret := nvml.DeviceGetRetiredPagesPendingStatus(device)
+	if ret == nvml.SUCCESS && retiredPending == nvml.FEATURE_ENABLED {
+		info.Reasons = append(info.Reasons, "retired memory pages pending")
+	}
+
+	_, _, remapPending, _, ret := nvml.DeviceGetRemappedRows(device)
+	if ret == nvml.SUCCESS && remapPending {
+		info.Reasons = append(info.Reasons, "memory row remapping pending")
+	}
+
+	info.RebootRequired = len(info.Reasons) > 0
+	return info, nil
+}
+
+// Read the instantaneous module power of a GPU in milliwatts through NVML field
+// values. Returns false when the board doesn't report it.
+func getModulePower(device nvml.Device) (uint32, bool) {
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_POWER_INSTANT, ScopeId: nvml.POWER_SCOPE_MODULE}}
+	if ret := nvml.DeviceGetFieldValues(device, values); ret != nvml.SUCCESS {
+		return 0, false
+	}
+	value, ok := fieldValue(values[0])
+	return uint32(value), ok
+}
+
+// Decode an NVML field value of an integer type. Returns false when NVML
+// couldn't read the field.
+func fieldValue(value nvml.FieldValue) (uint64, bool) {
+	if nvml.Return(value.NvmlReturn) != nvml.SUCCESS {
+		return 0, false
+	}
+
+	switch nvml.ValueType(value.ValueType) {
+	case nvml.VALUE_TYPE_UNSIGNED_INT, nvml.VALUE_TYPE_SIGNED_INT:
+		return uint64(binary.LittleEndian.Uint32(value.Value[:4])), true
+	case nvml.VALUE_TYPE_UNSIGNED_LONG, nvml.VALUE_TYPE_UNSIGNED_LONG_LONG, nvml.VALUE_TYPE_SIGNED_LONG_LONG:
+		return binary.LittleEndian.Uint64(value.Value[:]), true
+	}
+	return 0, false
+}
+
+// Read the active NVLink links of a GPU with their data counters. GPUs
+// without NVLink have no links.
+func getNvlinkStatus(device nvml.Device) []NvlinkStatus {
+	var links []NvlinkStatus
+	for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+		state, ret := nvml.DeviceGetNvLinkState(device, link)
+		if ret == nvml.ERROR_NOT_SUPPORTED && link == 0 {
+			return nil
+		}
+		if ret != nvml.SUCCESS || state != nvml.FEATURE_ENABLED {
+			continue
+		}
+
+		status := NvlinkStatus{Link: link}
+		values := []nvml.FieldValue{
+			{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX, ScopeId: uint32(link)},
+			{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX, ScopeId: uint32(link)},
+		}
+		if nvml.DeviceGetFieldValues(device, values) == nvml.SUCCESS {
+			status.TxKiB, _ = fieldValue(values[0])
+			status.RxKiB, _ = fieldValue(values[1])
+		}
+		links = append(links, status)
+	}
+	return links
+}
+
+// Read the power usage of a GPU in watts from the hwmon sensor of its DRM
+// device in sysfs, matched by PCI bus ID
+func readSysfsPowerUsage(device nvml.Device) (uint32, error) {
+	pci, ret := nvml.DeviceGetPciInfo(device)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError("get PCI info", ret)
+	}
+	busID := fmt.Sprintf("%04x:%02x:%02x.0", pci.Domain, pci.Bus, pci.Device)
+
+	cards, _ := filepath.Glob("/sys/class/drm/card*/device")
+	for _, card := range cards {
+		target, err := filepath.EvalSymlinks(card)
+		if err != nil || filepath.Base(target) != busID {
+			continue
+		}
+
+		// Sensors report microwatts, as an average or an instantaneous reading
+		for _, name := range []string{"power1_average", "power1_input"} {
+			files, _ := filepath.Glob(filepath.Join(card, "hwmon", "hwmon*", name))
+			for _, file := range files {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					continue
+				}
+				microwatts, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+				if err != nil {
+					continue
+				}
+				return uint32(microwatts / 1000000), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no hwmon power sensor found for %s", busID)
+}
+
+// Get the load of a GPU as a percentage: the higher of its utilization
+// and its power usage relative to the current power limit
+func gpuLoadPercent(info GPUInfo) uint32 {
+	load := info.Utilization
+	if info.PowerLimit > 0 {
+		powerPercent := info.PowerUsage * 100 / info.PowerLimit
+		if powerPercent > load {
+			load = powerPercent
+		}
+	}
+	return load
+}
+
+// Check whether a set request should leave a GPU untouched
+func shouldSkipGPU(index int, opts skipOptions) (GPUInfo, bool) {
+	if opts.busyThreshold == 0 && !opts.skipBusy {
+		return GPUInfo{}, false
+	}
+
+	info, err := getGPUInfo(index)
+	if err != nil {
+		// Can't tell how busy the GPU is, so don't skip it
+		logError("GPU %d: Failed to read GPU state for skip checks: %v", index, err)
+		return info, false
+	}
+
+	if opts.skipBusy {
+		processes, err := getComputeProcessCount(index)
+		if err != nil {
+			logError("GPU %d: Failed to read compute processes: %v", index, err)
+		} else if processes > 0 {
+			info.SkipReason = fmt.Sprintf("%d compute process(es) running", processes)
+			return info, true
+		}
+	}
+
+	if opts.busyThreshold > 0 {
+		load := gpuLoadPercent(info)
+		if load < opts.busyThreshold {
+			info.SkipReason = fmt.Sprintf("load %d%% below busy threshold %d%%", load, opts.busyThreshold)
+			return info, true
+		}
+	}
+
+	return info, false
+}
+
+// Get the number of compute processes running on a specific GPU
+func getComputeProcessCount(index int) (int, error) {
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError("get handle", ret)
+	}
+
+	processes, ret := nvml.DeviceGetComputeRunningProcesses(device)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError("get compute processes", ret)
+	}
+
+	return len(processes), nil
+}
+
+// Check that a percentOf value is valid
+func validatePercentOf(percentOf string) error {
+	if percentOf != "" && percentOf != "max" && percentOf != "default" {
+		return fmt.Errorf("invalid percentOf: %s (must be 'max' or 'default')", percentOf)
+	}
+	return nil
+}
+
+// Get the power limit range and default limit of a specific GPU
+func getPowerRange(index int) (PowerRange, error) {
+	var powerRange PowerRange
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return powerRange, nvmlError("get handle", ret)
+	}
+
+	mode, ret := nvml.DeviceGetPowerManagementMode(device)
+	if ret != nvml.SUCCESS {
+		return powerRange, nvmlError("get power management mode", ret)
+	}
+	if mode != nvml.FEATURE_ENABLED {
+		return powerRange, ErrPowerMgmtUnsupported
+	}
+
+	minLimit, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
+	if ret != nvml.SUCCESS {
+		return powerRange, nvmlError("get power limit constraints", ret)
+	}
+	defaultLimit, ret := nvml.DeviceGetPowerManagementDefaultLimit(device)
+	if ret != nvml.SUCCESS {
+		return powerRange, nvmlError("get default power limit", ret)
+	}
+
+	powerRange.Min = minLimit / 1000 // Convert to watts
+	powerRange.Max = maxLimit / 1000
+	powerRange.Default = defaultLimit / 1000
+	return powerRange, nil
+}
+
+// Resolve a percentage into a power limit in watts for a specific GPU.
+// percentOf selects the reference: the maximum limit ("max", the default)
+// or the default limit ("default", the card's stock TDP).
+func resolvePercentLimit(index int, percent uint32, percentOf string) (uint32, error) {
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return 0, nvmlError("get handle", ret)
+	}
+
+	var referenceMW uint32
+	if percentOf == "default" {
+		defaultLimit, ret := nvml.DeviceGetPowerManagementDefaultLimit(device)
+		if ret != nvml.SUCCESS {
+			return 0, nvmlError("get default power limit", ret)
+		}
+		referenceMW = defaultLimit
+	} else {
+		_, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
+		if ret != nvml.SUCCESS {
+			return 0, nvmlError("get power limit constraints", ret)
+		}
+		referenceMW = maxLimit
+	}
+
+	return uint32(uint64(referenceMW) * uint64(percent) / 100 / 1000), nil
+}
+
+// Set power limit for a specific GPU from a value in watts or a percentage
+func setPowerLimitValue(index int, value limitValue, percentOf string, opts applyOptions) (GPUInfo, error) {
+	if value.overUse {
+		// Usage is sampled once, so a momentarily idle GPU gets a tight limit
+		gpuInfo, err := getGPUInfo(index)
+		if err != nil {
+			return GPUInfo{}, err
+		}
+		return setPowerLimit(index, gpuInfo.PowerUsage+value.headroom, opts)
+	}
+
+	if value.percent == 0 {
+		return setPowerLimit(index, value.watts, opts)
+	}
+
+	limitWatts, err := resolvePercentLimit(index, value.percent, percentOf)
+	if err != nil {
+		return GPUInfo{}, err
+	}
+	return setPowerLimit(index, limitWatts, opts)
+}
+
+// Describe a power limit value for output
+func describeLimit(value limitValue, percentOf string) string {
+	if value.overUse {
+		return fmt.Sprintf("current usage + %d watts", value.headroom)
+	}
+	if value.percent == 0 {
+		return fmt.Sprintf("%d watts", value.watts)
+	}
+	if percentOf == "" {
+		percentOf = "max"
+	}
+	return fmt.Sprintf("%d%% of %s power limit", value.percent, percentOf)
+}
+
+// Describe the outcome of a set request for output
+func describeResult(gpuInfo GPUInfo) string {
+	if gpuInfo.DryRun {
+		return fmt.Sprintf("would be set to %d W (dry run)", gpuInfo.PowerLimit)
+	}
+	return fmt.Sprintf("set to %d W", gpuInfo.PowerLimit)
+}
+
+// Set power limit for a specific GPU
+func setPowerLimit(index int, limitWatts uint32, opts applyOptions) (GPUInfo, error) {
+	info, err := applyPowerLimit(index, limitWatts, opts)
+	if !opts.dryRun {
+		countSet(err)
+	}
+	return info, err
+}
+
+// Check, clamp and apply a power limit for setPowerLimit
+func applyPowerLimit(index int, limitWatts uint32, opts applyOptions) (GPUInfo, error) {
+	// Check that the GPU exists
+	count, ret := deviceCount()
+	if ret != nvml.SUCCESS {
+		return GPUInfo{}, nvmlError("get device count", ret)
+	}
+	if index < 0 || index >= count {
+		return GPUInfo{}, fmt.Errorf("%w: GPU index %d (found %d GPUs)", ErrOutOfRange, index, count)
+	}
+	if !isGPUVisible(index) {
+		return GPUInfo{}, fmt.Errorf("%w: GPU %d is not in NVIDIA_POWER_VISIBLE", ErrNotVisible, index)
+	}
+
+	// Get device handle
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return GPUInfo{}, nvmlError("get handle", ret)
+	}
+
+	// Check if power management is supported
+	mode, ret := nvml.DeviceGetPowerManagementMode(device)
+	if ret != nvml.SUCCESS {
+		return GPUInfo{}, nvmlError("get power management mode", ret)
+	}
+	if mode != nvml.FEATURE_ENABLED {
+		return GPUInfo{}, ErrPowerMgmtUnsupported
+	}
+
+	// Get power limit constraints
+	minLimit, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
+	if ret != nvml.SUCCESS {
+		return GPUInfo{}, nvmlError("get power limit constraints", ret)
+	}
+
+	// Remember the current limit for the change log
+	oldLimit, ret := nvml.DeviceGetPowerManagementLimit(device)
+	if ret != nvml.SUCCESS {
+		return GPUInfo{}, nvmlError("get current power limit", ret)
+	}
+
+	configMutex.RLock()
+	maxWatts, delay := policyMaxWatts, settleDelay
+	configMutex.RUnlock()
+
+	// Apply the site policy before the hardware range
+	if maxWatts > 0 && limitWatts > maxWatts && opts.strict {
+		return GPUInfo{}, fmt.Errorf("%w: GPU %d limit %d W is above the policy maximum %d W",
+			ErrOutOfRange, index, limitWatts, maxWatts)
+	}
+	requestedWatts := limitWatts
+	if maxWatts > 0 && limitWatts > maxWatts {
+		logClamp(index, requestedWatts, "GPU %d: Desired limit %d W above policy maximum %d W, capping to %d W",
+			index, limitWatts, maxWatts, maxWatts)
+		limitWatts = maxWatts
+	}
+
+	// Convert watts to milliwatts
+	limitMW := limitWatts * 1000
+
+	// Clamp to allowed range
+	if limitMW < minLimit && allowBelowMin {
+		logWarning("GPU %d: WARNING: Desired limit %d W below minimum %d W, trying it anyway (--unsafe-allow-below-min)",
+			index, limitWatts, minLimit/1000)
+	} else if ((limitMW < minLimit || limitMW > maxLimit) && opts.strict) || (limitMW < minLimit && opts.rejectLow) {
+		return GPUInfo{}, fmt.Errorf("%w: GPU %d limit %d W (allowed %d-%d W)",
+			ErrOutOfRange, index, limitWatts, minLimit/1000, maxLimit/1000)
+	} else if limitMW < minLimit {
+		limitMW = minLimit
+		logClamp(index, requestedWatts, "GPU %d: Desired limit %d W below minimum %d W, setting to %d W",
+			index, limitWatts, minLimit/1000, limitMW/1000)
+	} else if limitMW > maxLimit {
+		limitMW = maxLimit
+		logClamp(index, requestedWatts, "GPU %d: Desired limit %d W above maximum %d W, setting to %d W",
+			index, limitWatts, maxLimit/1000, limitMW/1000)
+	}
+	clamped := limitMW != requestedWatts*1000
+
+	// Nothing to do if the limit is already in place
+	if limitMW == oldLimit {
+		if !opts.dryRun {
+			setLastApplied(index, limitMW/1000)
+		}
+		info, err := getGPUInfo(index)
+		info.Unchanged = true
+		info.DryRun = opts.dryRun
+		setClampResult(&info, clamped, requestedWatts)
+		return info, err
+	}
+
+	// Report what would change without touching the GPU
+	if opts.dryRun {
+		info, err := getGPUInfo(index)
+		info.PowerLimit = limitMW / 1000
+		info.DryRun = true
+		setClampResult(&info, clamped, requestedWatts)
+		return info, err
+	}
+
+	// Some drivers misbehave when limits change in quick succession
+	if err := claimSetSlot(index); err != nil && !opts.rollback && !opts.benchmark {
+		return GPUInfo{}, err
+	}
+
+	// Fail like the driver would, only where a real set could fail
+	if err := simulatedFailure(); err != nil {
+		return GPUInfo{}, err
+	}
+
+	// Step through intermediate limits to avoid a sudden power transient
+	reachedMW := oldLimit
+	if opts.ramp != nil && opts.ramp.Steps > 1 {
+		stepDelay := time.Duration(opts.ramp.DurationMs) * time.Millisecond / time.Duration(opts.ramp.Steps-1)
+		for step := 1; step < opts.ramp.Steps; step++ {
+			stepMW := uint32(int64(oldLimit) + (int64(limitMW)-int64(oldLimit))*int64(step)/int64(opts.ramp.Steps))
+			ret = nvml.DeviceSetPowerManagementLimit(device, stepMW)
+			if ret != nvml.SUCCESS {
+				abandonRamp(index, device, oldLimit, reachedMW, opts.source)
+				return GPUInfo{}, nvmlError("set intermediate power limit", ret)
+			}
+			reachedMW = stepMW
+			time.Sleep(stepDelay)
+		}
+	}
+
+	// Set the new power limit
+	ret = nvml.DeviceSetPowerManagementLimit(device, limitMW)
+	if ret != nvml.SUCCESS {
+		abandonRamp(index, device, oldLimit, reachedMW, opts.source)
+		return GPUInfo{}, nvmlError("set power limit", ret)
+	}
+	setLastApplied(index, limitMW/1000)
+
+	// Some drivers keep reporting the old limit for a moment after a set, which
+	// would make the change look like it didn't take
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	// Get updated GPU info after change
+	info, err := getGPUInfo(index)
+	if err == nil && info.PowerLimit != oldLimit/1000 && !opts.benchmark {
+		recordLimitChange(index, oldLimit/1000, info.PowerLimit, opts.source)
+	}
+	setClampResult(&info, clamped, requestedWatts)
+	return info, err
+}
+
+// Fail a set operation on purpose for resilience testing, failRate of the time
+func simulatedFailure() error {
+	if failRate > 0 && mathrand.Float64() < failRate {
+		return fmt.Errorf("%w: simulated failure (--test-mode failRate)", ErrNVML)
+	}
+	return nil
+}
+
+// Put a GPU back on its old limit after a ramp failed part of the way. If that
+// fails too, record the intermediate limit it was left on, so the change log and
+// drift monitoring match the hardware.
+func abandonRamp(index int, device nvml.Device, oldLimitMW, reachedMW uint32, source string) {
+	if reachedMW == oldLimitMW {
+		return
+	}
+	ret := nvml.DeviceSetPowerManagementLimit(device, oldLimitMW)
+	if ret == nvml.SUCCESS {
+		logWarning("GPU %d: Ramp failed, power limit restored to %d W", index, oldLimitMW/1000)
+		return
+	}
+	logError("GPU %d: Ramp failed and restoring %d W failed too, left at %d W: %v",
+		index, oldLimitMW/1000, reachedMW/1000, nvml.ErrorString(ret))
+	setLastApplied(index, reachedMW/1000)
+	recordLimitChange(index, oldLimitMW/1000, reachedMW/1000, source)
+}
+
+// Mark a set result whose limit was clamped, with the limit that was asked for
+func setClampResult(info *GPUInfo, clamped bool, requestedWatts uint32) {
+	if clamped {
+		info.Clamped = true
+		info.RequestedLimit = requestedWatts
+	}
+}
+
+// Severity of a log message, which outputs such as syslog keep with it
+type logSeverity int
+
+const (
+	severityInfo logSeverity = iota
+	severityWarning
+	severityError
+)
+
+// Output for messages with a severity, set by logToSyslog; nil writes them to the standard logger
+var severityLog func(severity logSeverity, message string)
+
+// Log a message with a severity
+func logAt(severity logSeverity, format string, args ...interface{}) {
+	if severityLog != nil {
+		severityLog(severity, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Log progress and changes made
+func logInfo(format string, args ...interface{}) {
+	logAt(severityInfo, format, args...)
+}
+
+// Log something that went wrong but was worked around, or may need attention
+func logWarning(format string, args ...interface{}) {
+	logAt(severityWarning, format, args...)
+}
+
+// Log a failure
+func logError(format string, args ...interface{}) {
+	logAt(severityError, format, args...)
+}
+
+// Log a failure and exit, like log.Fatalf
+func logFatal(format string, args ...interface{}) {
+	logError(format, args...)
+	os.Exit(1)
+}
+
+// Clamp log messages already written, per GPU and requested limit, for clampLogging "once"
+var loggedClamps = make(map[[2]uint32]bool)
+var loggedClampsMutex sync.Mutex
+
+// Log that a requested limit was clamped, as often as clampLogging allows
+func logClamp(index int, requestedWatts uint32, format string, args ...interface{}) {
+	configMutex.RLock()
+	logging := clampLogging
+	configMutex.RUnlock()
+
+	switch logging {
+	case "off":
+		return
+	case "once":
+		key := [2]uint32{uint32(index), requestedWatts}
+		loggedClampsMutex.Lock()
+		seen := loggedClamps[key]
+		loggedClamps[key] = true
+		loggedClampsMutex.Unlock()
+		if seen {
+			return
+		}
+	}
+	logWarning(format, args...)
+}
+
+// Record a limit change on a GPU unless its previous one was less than setCooldown ago,
+// in which case return a cooldownError saying how long to wait
+func claimSetSlot(index int) error {
+	configMutex.RLock()
+	cooldown := setCooldown
+	configMutex.RUnlock()
+
+	if cooldown <= 0 {
+		return nil
+	}
+	lastSetTimesMutex.Lock()
+	defer lastSetTimesMutex.Unlock()
+	if retryIn := time.Until(lastSetTimes[index].Add(cooldown)); retryIn > 0 {
+		return &cooldownError{index: index, cooldown: cooldown, retryIn: retryIn}
+	}
+	lastSetTimes[index] = time.Now()
+	return nil
+}
+
+// Remember the power limit this process applied to a GPU
+func setLastApplied(index int, limitWatts uint32) {
+	lastAppliedMutex.Lock()
+	defer lastAppliedMutex.Unlock()
+	lastApplied[index] = limitWatts
+}
+
+// Record a power limit change in the GPU's change log
+func recordLimitChange(index int, oldLimit, newLimit uint32, source string) {
+	changeLogMutex.Lock()
+	defer changeLogMutex.Unlock()
+
+	now := time.Now()
+	changes := append(changeLog[index], LimitChange{
+		Timestamp: now,
+		OldLimit:  oldLimit,
+		NewLimit:  newLimit,
+		Source:    source,
+	})
+	if len(changes) > maxChangesPerGPU {
+		changes = changes[len(changes)-maxChangesPerGPU:]
+	}
+	changeLog[index] = changes
+
+	auditSeq++
+	auditLog = append(auditLog, AuditEntry{Seq: auditSeq, Timestamp: now, Index: index, OldLimit: oldLimit, NewLimit: newLimit, Source: source})
+	if len(auditLog) > maxAuditEntries {
+		auditLog = auditLog[len(auditLog)-maxAuditEntries:]
+	}
+	changeCond.Broadcast()
+}
+
+// Get the indices of the GPUs whose limit changed after a point in time.
+// The caller must hold changeLogMutex.
+func changedGPUsSince(since time.Time) []int {
+	var indices []int
+	for index, changes := range changeLog {
+		if len(changes) > 0 && changes[len(changes)-1].Timestamp.After(since) {
+			indices = append(indices, index)
+		}
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Get up to limit audit entries after sequence number after and recorded after
+// a point in time, oldest first
+func getAuditEntries(after uint64, since time.Time, limit int) []AuditEntry {
+	changeLogMutex.Lock()
+	defer changeLogMutex.Unlock()
+
+	start := sort.Search(len(auditLog), func(i int) bool {
+		return auditLog[i].Seq > after && auditLog[i].Timestamp.After(since)
+	})
+	end := min(start+limit, len(auditLog))
+	return append([]AuditEntry{}, auditLog[start:end]...)
+}
+
+// Get the change log of a GPU, oldest change first
+func getLimitChanges(index int) []LimitChange {
+	changeLogMutex.Lock()
+	defer changeLogMutex.Unlock()
+	return append([]LimitChange{}, changeLog[index]...)
+}
+
+// Lock the GPU clocks of a specific GPU to a range
+func setLockedClocks(index int, minClock, maxClock uint32) (LockedClocksInfo, error) {
+	info := LockedClocksInfo{Index: index, Supported: true}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	ret = nvml.DeviceSetGpuLockedClocks(device, minClock, maxClock)
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		info.Supported = false
+		return info, fmt.Errorf("clock locking %w", ErrNotSupported)
+	}
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("set locked clocks", ret)
+	}
+
+	info.MinClock = minClock
+	info.MaxClock = maxClock
+	info.Locked = true
+	return info, nil
+}
+
+// Reset the GPU clocks of a specific GPU to their default behavior
+func resetLockedClocks(index int) (LockedClocksInfo, error) {
+	info := LockedClocksInfo{Index: index, Supported: true}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	ret = nvml.DeviceResetGpuLockedClocks(device)
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		info.Supported = false
+		return info, fmt.Errorf("clock locking %w", ErrNotSupported)
+	}
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("reset locked clocks", ret)
+	}
+
+	return info, nil
+}
+
+// Enable or disable auto-boosted clocks on a specific GPU
+func setAutoBoost(index int, enabled bool) (AutoBoostInfo, error) {
+	info := AutoBoostInfo{Index: index, Supported: true}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	state := nvml.FEATURE_DISABLED
+	if enabled {
+		state = nvml.FEATURE_ENABLED
+	}
+	ret = nvml.DeviceSetAutoBoostedClocksEnabled(device, state)
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		info.Supported = false
+		return info, fmt.Errorf("auto-boost %w", ErrNotSupported)
+	}
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("set auto-boost", ret)
+	}
+
+	current, defaultState, ret := nvml.DeviceGetAutoBoostedClocksEnabled(device)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get auto-boost", ret)
+	}
+	info.Enabled = current == nvml.FEATURE_ENABLED
+	info.DefaultEnabled = defaultState == nvml.FEATURE_ENABLED
+	return info, nil
+}
+
+// Set every fan of a specific GPU to a fixed speed in percent, or back to
+// automatic control when speed is nil
+func setFanSpeed(index int, speed *int) (FanInfo, error) {
+	info := FanInfo{Index: index, Supported: true}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	fans, ret := nvml.DeviceGetNumFans(device)
+	if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_FUNCTION_NOT_FOUND || (ret == nvml.SUCCESS && fans == 0) {
+		info.Supported = false
+		return info, fmt.Errorf("fan control %w", ErrNotSupported)
+	}
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get fan count", ret)
+	}
+
+	minSpeed, maxSpeed, ret := nvml.DeviceGetMinMaxFanSpeed(device)
+	if ret == nvml.SUCCESS {
+		info.MinSpeed, info.MaxSpeed = minSpeed, maxSpeed
+	}
+	if speed != nil && info.MaxSpeed > 0 && (*speed < info.MinSpeed || *speed > info.MaxSpeed) {
+		return info, fmt.Errorf("%w: fan speed %d%% (must be between %d%% and %d%%)", ErrOutOfRange, *speed, info.MinSpeed, info.MaxSpeed)
+	}
+
+	for fan := 0; fan < fans; fan++ {
+		if speed != nil {
+			ret = nvml.DeviceSetFanControlPolicy(device, fan, nvml.FAN_POLICY_MANUAL)
+			if ret == nvml.SUCCESS || ret == nvml.ERROR_NOT_SUPPORTED {
+				ret = nvml.DeviceSetFanSpeed_v2(device, fan, *speed)
+			}
+		} else {
+			ret = nvml.DeviceSetDefaultFanSpeed_v2(device, fan)
+		}
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			info.Supported = false
+			return info, fmt.Errorf("fan control %w", ErrNotSupported)
+		}
+		if ret != nvml.SUCCESS {
+			return info, nvmlError(fmt.Sprintf("set fan %d speed", fan), ret)
+		}
+	}
+
+	for fan := 0; fan < fans; fan++ {
+		state := FanState{Fan: fan}
+		state.Speed, _ = nvml.DeviceGetFanSpeed_v2(device, fan)
+		policy, ret := nvml.DeviceGetFanControlPolicy_v2(device, fan)
+		state.Manual = ret == nvml.SUCCESS && policy == nvml.FAN_POLICY_MANUAL
+		info.Fans = append(info.Fans, state)
+	}
+	return info, nil
+}
+
+// API middleware for authentication
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+
+		// Check if API key is valid
+		entry, ok := findAPIKey(apiKey)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid API key"})
+			return
+		}
+
+		// Read-only keys may look but not touch
+		if entry.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "API key is read-only"})
+			return
+		}
+
+		// Scoped keys only reach their own paths, and /api/info to see that scope.
+		// getJobHandler lets them poll the jobs they started.
+		if !entry.allowsPath(r.URL.Path) && r.URL.Path != "/api/info" && !strings.HasPrefix(r.URL.Path, "/api/jobs/") {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("API key may not access %s", r.URL.Path)})
+			return
+		}
+
+		// Call the next handler
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, entry)))
+	})
+}
+
+// API middleware that rejects POST, PUT and PATCH requests with a body that isn't JSON
+func jsonContentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) && r.ContentLength != 0 {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Content-Type must be application/json"})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// API middleware that rejects requests with 503 once the given number are
+// already in flight. Reads and writes share the budget; long-lived
+// /api/stream and /api/gpus/changes connections are not counted.
+func concurrencyLimitMiddleware(limit int) func(http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/stream" || r.URL.Path == "/api/gpus/changes" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Too many concurrent requests"})
+			}
+		})
+	}
+}
+
+// Build the set of accepted API keys from config. Keys added through /api/keys
+// are kept, unless the config now has a key with the same label.
+func initAPIKeys(cfg Config) error {
+	var keys []APIKeyEntry
+	if cfg.APIKey != "" {
+		keys = append(keys, APIKeyEntry{Label: legacyAPIKeyLabel, Key: cfg.APIKey, Admin: true})
+	}
+	for _, entry := range cfg.APIKeys {
+		if err := validateAPIKeyEntry(keys, entry); err != nil {
+			return err
+		}
+		keys = append(keys, entry)
+	}
+	labels := make(map[string]bool, len(keys))
+	for _, entry := range keys {
+		labels[entry.Label] = true
+	}
+
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	for _, entry := range apiKeys {
+		if configAPIKeyLabels[entry.Label] {
+			continue
+		}
+		if labels[entry.Label] {
+			if !cfg.PersistAPIKeys {
+				logWarning("API key %s added at runtime is replaced by the one in the config", entry.Label)
+			}
+			continue
+		}
+		keys = append(keys, entry)
+	}
+	apiKeys = keys
+	configAPIKeyLabels = labels
+	return nil
+}
+
+// Check that a new API key entry is complete and its label is unused
+func validateAPIKeyEntry(keys []APIKeyEntry, entry APIKeyEntry) error {
+	if entry.Label == "" || entry.Key == "" {
+		return fmt.Errorf("API keys need both a label and a key")
+	}
+	if entry.Admin && entry.ReadOnly {
+		return fmt.Errorf("API key %s can't be both admin and read-only", entry.Label)
+	}
+	for _, prefix := range entry.AllowedPaths {
+		if !strings.HasPrefix(prefix, "/api/") {
+			return fmt.Errorf("invalid allowedPaths entry for API key %s: %s (must start with /api/)", entry.Label, prefix)
+		}
+	}
+	for _, existing := range keys {
+		if existing.Label == entry.Label {
+			return fmt.Errorf("duplicate API key label: %s", entry.Label)
+		}
+	}
+	return nil
+}
+
+// Check whether a key may use an API path. A prefix matches the path itself
+// and the paths below it, so /api/gpus allows /api/gpus/0 but not /api/gpusx.
+func (entry APIKeyEntry) allowsPath(path string) bool {
+	if len(entry.AllowedPaths) == 0 {
+		return true
+	}
+	for _, prefix := range entry.AllowedPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the entry matching an API key
+func findAPIKey(apiKey string) (APIKeyEntry, bool) {
+	if apiKey == "" {
+		return APIKeyEntry{}, false
+	}
+
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+
+	var match APIKeyEntry
+	found := false
+	for _, entry := range apiKeys {
+		// Compare every key in constant time so timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(entry.Key), []byte(apiKey)) == 1 {
+			match = entry
+			found = true
+		}
+	}
+	return match, found
+}
+
+// Get the labels of all accepted API keys
+func apiKeyLabels() []APIKeyLabel {
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+
+	labels := make([]APIKeyLabel, 0, len(apiKeys))
+	for _, entry := range apiKeys {
+		labels = append(labels, APIKeyLabel{Label: entry.Label, Admin: entry.Admin, ReadOnly: entry.ReadOnly, AllowedPaths: entry.AllowedPaths})
+	}
+	return labels
+}
+
+// Write the current API keys back to the config file, leaving other fields untouched
+func persistAPIKeys(keys []APIKeyEntry) error {
+	if isRemoteConfig(configPath) {
+		return fmt.Errorf("can't write API keys back to a remote config (%s)", configPath)
+	}
+
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", configPath, err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(configData, &raw); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+
+	legacyKey := ""
+	extraKeys := []APIKeyEntry{}
+	for _, entry := range keys {
+		if entry.Label == legacyAPIKeyLabel {
+			legacyKey = entry.Key
+			continue
+		}
+		extraKeys = append(extraKeys, entry)
+	}
+	raw["apiKey"], _ = json.Marshal(legacyKey)
+	raw["apiKeys"], _ = json.Marshal(extraKeys)
+
+	updated, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write can't corrupt the config
+	tmpPath := configPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, updated, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, configPath)
+}
+
+// Mutating operations that disabledOperations can turn off, each covering its endpoints
+var operationNames = []string{"power", "lockedClocks", "autoBoost", "fan", "keys"}
+
+// API middleware that answers 403 when the operation is in disabledOperations
+func operation(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(currentConfig().DisabledOperations, name) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Operation disabled: %s", name)})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// API middleware that only allows admin keys
+func adminKeyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, _ := r.Context().Value(apiKeyContextKey{}).(APIKeyEntry)
+		if !entry.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Admin API key required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Response writer that keeps a copy of the status and body it writes
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// Response writer that holds the response back so it can be rewritten
+type bufferingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferingResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferingResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// Let http.ResponseController reach the connection, for write deadlines
+func (w *bufferingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Metadata included in every API response envelope
+type ResponseMeta struct {
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"requestId"`
+}
+
+// Generate a random (version 4) UUID
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		logWarning("Warning: Failed to generate request ID: %v", err)
+	}
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// API middleware that tags each request with an X-Request-ID and wraps the JSON
+// response as {"data": ..., "meta": ...}, or {"error": ..., "meta": ...} on failure.
+// Server-sent event streams and empty responses are passed through unchanged.
+func envelopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := newRequestID()
+		w.Header().Set("X-Request-ID", requestID)
+		if r.URL.Path == "/api/stream" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffer := &bufferingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffer, r)
+
+		body := bytes.TrimSpace(buffer.body.Bytes())
+		if len(body) == 0 || !json.Valid(body) {
+			w.WriteHeader(buffer.status)
+			w.Write(buffer.body.Bytes())
+			return
+		}
+
+		meta := ResponseMeta{Timestamp: time.Now().UTC(), RequestID: requestID}
+		envelope := map[string]interface{}{"meta": meta}
+		if buffer.status >= http.StatusBadRequest {
+			// Error bodies are objects, their fields move into the envelope
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(body, &fields); err == nil {
+				for name, value := range fields {
+					envelope[name] = value
+				}
+			} else {
+				envelope["error"] = json.RawMessage(body)
+			}
+		} else {
+			envelope["data"] = json.RawMessage(body)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffer.status)
+		json.NewEncoder(w).Encode(envelope)
+	})
+}
+
+// API middleware that replays the stored response when a request is retried
+// with the same Idempotency-Key instead of applying it again
+func idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read request body"})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		requestHash := sha256.Sum256(body)
+
+		ttl := time.Duration(currentConfig().IdempotencyTTL)
+		if ttl <= 0 {
+			ttl = defaultIdempotencyTTL
+		}
+
+		idempotencyMutex.Lock()
+		now := time.Now()
+		for storedKey, stored := range idempotencyKeys {
+			if stored.done && now.After(stored.expires) {
+				delete(idempotencyKeys, storedKey)
+			}
+		}
+
+		if stored, ok := idempotencyKeys[key]; ok {
+			idempotencyMutex.Unlock()
+			switch {
+			case stored.requestHash != requestHash:
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Idempotency-Key was already used with a different request"})
+			case !stored.done:
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				w.Header().Set("Content-Type", stored.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.status)
+				w.Write(stored.body)
+			}
+			return
+		}
+
+		stored := &idempotentResponse{requestHash: requestHash}
+		idempotencyKeys[key] = stored
+		idempotencyMutex.Unlock()
+
+		recorder := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		idempotencyMutex.Lock()
+		defer idempotencyMutex.Unlock()
+		if recorder.status >= http.StatusInternalServerError {
+			// Let the client retry server errors for real
+			delete(idempotencyKeys, key)
+			return
+		}
+		stored.done = true
+		stored.status = recorder.status
+		stored.contentType = recorder.Header().Get("Content-Type")
+		stored.body = recorder.body.Bytes()
+		stored.expires = time.Now().Add(ttl)
+	}
+}
+
+// Background apply started by an async request
+type Job struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"` // "running" or "done"
+	Created    time.Time       `json:"created"`
+	Finished   *time.Time      `json:"finished,omitempty"`
+	HTTPStatus int             `json:"httpStatus,omitempty"` // Status the request would have answered with synchronously
+	Result     json.RawMessage `json:"result,omitempty"`     // Body the request would have answered with synchronously
+	owner      string          // Label of the API key that started the job
+	expires    time.Time
+}
+
+// Async jobs by ID, kept for the job TTL once done
+var jobs = make(map[string]*Job)
+var jobsMutex sync.Mutex
+
+// Response writer that captures the response of a background job
+type jobResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *jobResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// Run a handler in the background as a job for the API key with a label and return the job ID
+func startJob(owner string, run func(w http.ResponseWriter)) string {
+	ttl := time.Duration(currentConfig().JobTTL)
+	if ttl <= 0 {
+		ttl = defaultJobTTL
+	}
+
+	job := &Job{ID: newRequestID(), Status: "running", Created: time.Now(), owner: owner}
+	jobsMutex.Lock()
+	now := time.Now()
+	for id, stored := range jobs {
+		if stored.Status == "done" && now.After(stored.expires) {
+			delete(jobs, id)
+		}
+	}
+	jobs[job.ID] = job
+	jobsMutex.Unlock()
+
+	go func() {
+		recorder := &jobResponseWriter{header: make(http.Header), status: http.StatusOK}
+		run(recorder)
+
+		jobsMutex.Lock()
+		defer jobsMutex.Unlock()
+		finished := time.Now()
+		job.Status = "done"
+		job.Finished = &finished
+		job.HTTPStatus = recorder.status
+		if body := bytes.TrimSpace(recorder.body.Bytes()); json.Valid(body) {
+			job.Result = body
+		}
+		job.expires = finished.Add(ttl)
+	}()
+	return job.ID
+}
+
+// API handler to get the status and result of an async job. Keys without
+// access to /api/jobs only see the jobs they started.
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entry, _ := r.Context().Value(apiKeyContextKey{}).(APIKeyEntry)
+
+	jobsMutex.Lock()
+	job, ok := jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	jobsMutex.Unlock()
+
+	if !ok || (snapshot.Status == "done" && time.Now().After(snapshot.expires)) ||
+		(!entry.allowsPath(r.URL.Path) && snapshot.owner != entry.Label) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Job %s not found", id)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// API handler to get all GPU information
+func getGPUsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get GPU data, refreshing it if the cache is stale
+	gpus, hit, err := getCachedGPUs()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Optionally return just ?indices=0,2,5, in that order
+	if value := r.URL.Query().Get("indices"); value != "" {
+		strict := r.URL.Query().Get("strict") != "false"
+		gpus, err = selectGPUs(gpus, value, strict)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	setCacheHeader(w, hit)
+	w.Header().Set("Content-Type", "application/json")
+	writeGPUJSON(w, gpus)
+}
+
+// API handler to get every GPU as an [index, powerUsage, powerLimit, temperature]
+// tuple, for collectors that poll many hosts and need less than getGPUsHandler sends
+func getCompactGPUsHandler(w http.ResponseWriter, r *http.Request) {
+	gpus, hit, err := getCachedGPUs()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tuples := make([][4]uint32, 0, len(gpus))
+	for _, gpuInfo := range gpus {
+		tuples = append(tuples, [4]uint32{uint32(gpuInfo.Index), gpuInfo.PowerUsage, gpuInfo.PowerLimit, gpuInfo.Temperature})
+	}
+
+	setCacheHeader(w, hit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tuples)
+}
+
+// Pick the GPUs with the given comma separated indices. Indices that aren't a
+// known, visible GPU are an error when strict and skipped otherwise.
+func selectGPUs(gpus []GPUInfo, indices string, strict bool) ([]GPUInfo, error) {
+	byIndex := make(map[int]GPUInfo, len(gpus))
+	for _, gpuInfo := range gpus {
+		byIndex[gpuInfo.Index] = gpuInfo
+	}
+
+	selected := []GPUInfo{}
+	for _, part := range strings.Split(indices, ",") {
+		part = strings.TrimSpace(part)
+		index, err := strconv.Atoi(part)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("invalid GPU index: %s", part)
+			}
+			continue
+		}
+		gpuInfo, ok := byIndex[index]
+		if !ok {
+			if strict {
+				return nil, fmt.Errorf("GPU %d not found", index)
+			}
+			continue
+		}
+		selected = append(selected, gpuInfo)
+	}
+	return selected, nil
+}
+
+// API handler to get a specific GPU's information
+func getGPUHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Get GPU data, refreshing only this GPU if the cache is stale
+	gpuInfo, hit, err := getCachedGPU(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	setCacheHeader(w, hit)
+	w.Header().Set("Content-Type", "application/json")
+	writeGPUJSON(w, gpuInfo)
+}
+
+// API handler to get the power limit range of a specific GPU, which only
+// changes with the hardware so clients may cache it
+func getPowerRangeHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	powerRange, err := getPowerRange(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(powerRange)
+}
+
+// API handler to set a specific GPU back to its default power limit
+func resetPowerLimitHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional. A reset is meant to undo earlier changes, so it is
+	// applied even with defaultDryRun unless the request asks for a dry run.
+	var request ResetRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+			return
+		}
+	}
+
+	powerRange, err := getPowerRange(index)
+	if err != nil {
+		logError("GPU %d: Failed to read default power limit: %v", index, err)
+		writeError(w, err)
+		return
+	}
+
+	gpuInfo, err := setPowerLimit(index, powerRange.Default, resolveApplyOptions("reset", nil, &request.DryRun))
+	if err != nil {
+		logError("GPU %d: Failed to reset power limit: %v", index, err)
+		writeError(w, err)
+		return
+	}
+	logInfo("GPU %d (%s): Reset to default, power limit %s", index, gpuInfo.Name, describeResult(gpuInfo))
+
+	if err := refreshGPUCache(); err != nil {
+		logWarning("Warning: Failed to refresh GPU cache: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeGPUJSON(w, gpuInfo)
+}
+
+// API handler to get the power limit changes of a specific GPU
+func getGPUChangesHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getLimitChanges(index))
+}
+
+// API handler that waits until any GPU's limit changes after ?since=<RFC 3339 timestamp>,
+// then returns the changed GPUs. Responds with 204 if nothing changed within ?timeout=.
+func waitGPUChangesHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid since (must be an RFC 3339 timestamp)"})
+		return
+	}
+
+	timeout := defaultLongPollTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > maxLongPollTimeout {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid timeout (must be a duration up to %v)", maxLongPollTimeout)})
+			return
+		}
+	}
+
+	// Give the response the usual write time after the wait
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Now().Add(timeout + durationOrDefault(currentConfig().WriteTimeout, defaultWriteTimeout))); err != nil {
+		logError("Long-poll: Failed to extend write deadline: %v", err)
+	}
+
+	// Wake the waiter below when the timeout passes or the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		changeLogMutex.Lock()
+		changeCond.Broadcast()
+		changeLogMutex.Unlock()
+	}()
+
+	changeLogMutex.Lock()
+	changed := changedGPUsSince(since)
+	for len(changed) == 0 && ctx.Err() == nil {
+		changeCond.Wait()
+		changed = changedGPUsSince(since)
+	}
+	changeLogMutex.Unlock()
+
+	if len(changed) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	gpus := make([]GPUInfo, 0, len(changed))
+	for _, index := range changed {
+		gpuInfo, err := getGPUInfo(index)
+		if err != nil {
+			logError("GPU %d: Failed to read GPU information: %v", index, err)
+			continue
+		}
+		gpus = append(gpus, gpuInfo)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeGPUJSON(w, gpus)
+}
+
+// Build the shortest command line that recreates the power limits of the given GPUs:
+// a single limit when they all match, otherwise one --gpu option per GPU
+func reproCommand(gpus []GPUInfo) string {
+	var limits []GPUInfo
+	for _, gpuInfo := range gpus {
+		if gpuInfo.Supported {
+			limits = append(limits, gpuInfo)
+		}
+	}
+	if len(limits) == 0 {
+		return "nvidia-power-control --list"
+	}
+
+	allEqual := true
+	for _, gpuInfo := range limits {
+		if gpuInfo.PowerLimit != limits[0].PowerLimit {
+			allEqual = false
+			break
+		}
+	}
+	if allEqual && len(limits) == len(gpus) {
+		return fmt.Sprintf("nvidia-power-control %d", limits[0].PowerLimit)
+	}
+
+	args := []string{"nvidia-power-control"}
+	for _, gpuInfo := range limits {
+		args = append(args, fmt.Sprintf("--gpu=%d:%d", gpuInfo.Index, gpuInfo.PowerLimit))
+	}
+	return strings.Join(args, " ")
+}
+
+// API handler describing what the request's API key may do
+func getInfoHandler(w http.ResponseWriter, r *http.Request) {
+	entry, _ := r.Context().Value(apiKeyContextKey{}).(APIKeyEntry)
+	info := APIInfo{
+		Key:          APIKeyLabel{Label: entry.Label, Admin: entry.Admin, ReadOnly: entry.ReadOnly, AllowedPaths: entry.AllowedPaths},
+		Capabilities: []string{"read"},
+	}
+	if !entry.ReadOnly {
+		info.Capabilities = append(info.Capabilities, "write")
+	}
+	if entry.Admin {
+		info.Capabilities = append(info.Capabilities, "manageKeys")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// API handler to get the command line that recreates the current power limits
+func getReproHandler(w http.ResponseWriter, r *http.Request) {
+	gpus, hit, err := getCachedGPUs()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	setCacheHeader(w, hit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"command": reproCommand(gpus)})
+}
+
+// API handler to check whether a specific GPU needs a reboot
+func getGPUPendingHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	pending, err := getPendingReboot(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending)
+}
+
+// Send power usage, limit and temperature gauges of the visible GPUs to a StatsD server
+func runStatsdLoop(addr, prefix string, interval time.Duration) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logError("StatsD: Failed to connect to %s: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	logInfo("Sending StatsD gauges to %s every %v", addr, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		gpus, _, err := getCachedGPUs()
+		if err != nil {
+			logError("StatsD: Failed to refresh GPU information: %v", err)
+		} else {
+			var packet bytes.Buffer
+			for _, gpu := range gpus {
+				name := fmt.Sprintf("%s.gpu%d", prefix, gpu.Index)
+				fmt.Fprintf(&packet, "%s.temperature:%d|g\n", name, gpu.Temperature)
+				if gpu.Supported {
+					fmt.Fprintf(&packet, "%s.power_usage:%d|g\n", name, gpu.PowerUsage)
+					fmt.Fprintf(&packet, "%s.power_limit:%d|g\n", name, gpu.PowerLimit)
+				}
+			}
+			// UDP is fire and forget, a missing server only shows up as a write error
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				logError("StatsD: Failed to send gauges: %v", err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// Start sending StatsD gauges in the background if the config asks for it
+func startStatsd(cfg Config) {
+	if cfg.StatsdAddr == "" {
+		return
+	}
+	prefix := cfg.StatsdPrefix
+	if prefix == "" {
+		prefix = defaultStatsdPrefix
+	}
+	interval := time.Duration(cfg.StatsdInterval)
+	if interval <= 0 {
+		interval = defaultStatsdInterval
+	}
+	go runStatsdLoop(cfg.StatsdAddr, prefix, interval)
+}
+
+// Power readings of a GPU in NVML's native milliwatts
+type powerSample struct {
+	index   int
+	name    string
+	usage   uint32
+	limit   uint32
+	minimum uint32
+	maximum uint32
+}
+
+// Power metrics exported at /metrics, without the unit suffix
+var powerMetrics = []struct {
+	name  string
+	help  string
+	value func(powerSample) uint32
+}{
+	{"nvidia_gpu_power_usage", "Current power usage", func(s powerSample) uint32 { return s.usage }},
+	{"nvidia_gpu_power_limit", "Current power limit", func(s powerSample) uint32 { return s.limit }},
+	{"nvidia_gpu_power_min_limit", "Minimum allowed power limit", func(s powerSample) uint32 { return s.minimum }},
+	{"nvidia_gpu_power_max_limit", "Maximum allowed power limit", func(s powerSample) uint32 { return s.maximum }},
+}
+
+// Escape a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format the Prometheus labels of a GPU's series, its index and name followed by its gpuLabels
+func sampleLabels(sample powerSample) string {
+	labels := fmt.Sprintf("gpu=\"%d\",name=\"%s\"", sample.index, labelEscaper.Replace(sample.name))
+	configMutex.RLock()
+	extra := gpuLabels[sample.index]
+	configMutex.RUnlock()
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		labels += fmt.Sprintf(",%s=\"%s\"", name, labelEscaper.Replace(extra[name]))
+	}
+	return labels
+}
+
+// Read the power values of a specific GPU without converting to watts
+func getPowerSample(index int) (powerSample, error) {
+	sample := powerSample{index: index}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return sample, nvmlError("get handle", ret)
+	}
+
+	name, ret := nvml.DeviceGetName(device)
+	if ret != nvml.SUCCESS {
+		name = "Unknown"
+	}
+	sample.name = name
+
+	sample.limit, ret = nvml.DeviceGetPowerManagementLimit(device)
+	if ret != nvml.SUCCESS {
+		return sample, nvmlError("get current power limit", ret)
+	}
+	sample.minimum, sample.maximum, ret = nvml.DeviceGetPowerManagementLimitConstraints(device)
+	if ret != nvml.SUCCESS {
+		return sample, nvmlError("get power limit constraints", ret)
+	}
+	sample.usage, ret = nvml.DeviceGetPowerUsage(device)
+	if ret != nvml.SUCCESS {
+		return sample, nvmlError("get power usage", ret)
+	}
+
+	return sample, nil
+}
+
+// Power samples shared by /metrics scrapes, kept in milliwatts unlike the GPU cache
+var powerSampleCache []powerSample
+var powerSampleCacheUpdated time.Time
+var powerSampleCacheMutex sync.Mutex
+
+// Get power samples of all visible GPUs, reusing the last ones while they are
+// younger than metricsMaxStaleness (default cacheTTL). The lock is held while
+// reading NVML, so concurrent scrapes share a single read.
+func getCachedPowerSamples() ([]powerSample, error) {
+	cfg := currentConfig()
+	maxAge := durationOrDefault(cfg.MetricsMaxStaleness, time.Duration(cfg.CacheTTL))
+
+	powerSampleCacheMutex.Lock()
+	defer powerSampleCacheMutex.Unlock()
+	if maxAge > 0 && powerSampleCache != nil && time.Since(powerSampleCacheUpdated) < maxAge {
+		return powerSampleCache, nil
+	}
+
+	count, ret := deviceCount()
+	if ret != nvml.SUCCESS {
+		return nil, nvmlError("get device count", ret)
+	}
+	samples := []powerSample{}
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		sample, err := getPowerSample(i)
+		if err != nil {
+			// GPUs without power management simply have no power metrics
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	powerSampleCache = samples
+	powerSampleCacheUpdated = time.Now()
+	return samples, nil
+}
+
+// Handler serving GPU power metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	samples, err := getCachedPowerSamples()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get GPU count"})
+		return
+	}
+
+	units := currentConfig().MetricsUnits
+	if units == "" {
+		units = "watts"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range powerMetrics {
+		if units == "watts" || units == "both" {
+			name := metric.name + "_watts"
+			fmt.Fprintf(w, "# HELP %s %s in watts\n# TYPE %s gauge\n", name, metric.help, name)
+			for _, sample := range samples {
+				watts := strconv.FormatFloat(float64(metric.value(sample))/1000, 'f', -1, 64)
+				fmt.Fprintf(w, "%s{%s} %s\n", name, sampleLabels(sample), watts)
+			}
+		}
+		if units == "milliwatts" || units == "both" {
+			name := metric.name + "_milliwatts"
+			fmt.Fprintf(w, "# HELP %s %s in milliwatts\n# TYPE %s gauge\n", name, metric.help, name)
+			for _, sample := range samples {
+				fmt.Fprintf(w, "%s{%s} %d\n", name, sampleLabels(sample), metric.value(sample))
+			}
+		}
+	}
+	writeCounters(w)
+	writeRuntimeMetrics(w)
+}
+
+// Go runtime and process metrics of the server itself (go_goroutines,
+// go_memstats_*, process_*), to watch for leaked goroutines and memory growth
+var runtimeMetrics = newRuntimeMetricsRegistry()
+
+// Build a registry with the standard Prometheus Go and process collectors
+func newRuntimeMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+// Write the runtime metrics in the Prometheus text format
+func writeRuntimeMetrics(w io.Writer) {
+	families, err := runtimeMetrics.Gather()
+	if err != nil {
+		logError("Metrics: Failed to gather runtime metrics: %v", err)
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			logError("Metrics: Failed to write runtime metrics: %v", err)
+			return
+		}
+	}
+}
+
+// Operation counters served on /metrics
+var setCounts = make(map[string]uint64)           // Set operations by result, "success" or "error"
+var apiRequestCounts = make(map[[2]string]uint64) // API requests by endpoint and status code
+var countersMutex sync.Mutex
+
+// Count a set operation by its outcome
+func countSet(err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	countersMutex.Lock()
+	setCounts[result]++
+	countersMutex.Unlock()
+}
+
+// Write the operation counters in the Prometheus text format, in a stable order
+func writeCounters(w io.Writer) {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP nvidia_power_set_total Power limit set operations\n# TYPE nvidia_power_set_total counter\n")
+	for _, result := range []string{"success", "error"} {
+		fmt.Fprintf(w, "nvidia_power_set_total{result=\"%s\"} %d\n", result, setCounts[result])
+	}
+
+	keys := make([][2]string, 0, len(apiRequestCounts))
+	for key := range apiRequestCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	fmt.Fprintf(w, "# HELP nvidia_power_api_requests_total API requests\n# TYPE nvidia_power_api_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "nvidia_power_api_requests_total{endpoint=\"%s\",status=\"%s\"} %d\n",
+			labelEscaper.Replace(key[0]), key[1], apiRequestCounts[key])
+	}
+}
+
+// Response writer that keeps the status code it writes
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Let http.ResponseController reach the underlying writer to flush streams
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// API middleware counting requests by the route pattern they match, so
+// /api/gpus/0 and /api/gpus/1 are one endpoint
+func requestCountMiddleware(api *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			endpoint := "unmatched"
+			if _, pattern := api.Handler(r); pattern != "" {
+				endpoint = pattern
+				if _, path, ok := strings.Cut(pattern, " "); ok {
+					endpoint = path
+				}
+			}
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+
+			countersMutex.Lock()
+			apiRequestCounts[[2]string{endpoint, strconv.Itoa(recorder.status)}]++
+			countersMutex.Unlock()
+		})
+	}
+}
+
+// API handler to get the most recent GPU events
+func getEventsHandler(w http.ResponseWriter, r *http.Request) {
+	recentEventsMutex.Lock()
+	events := append([]GPUEvent{}, recentEvents...)
+	recentEventsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// API handler to get the audit log of power limit changes, oldest first. Pages
+// through the log with ?after=<seq of the last entry received>&limit=N, and
+// ?since=<timestamp> leaves out older entries. Timestamps aren't a cursor, as
+// changes applied together can share one.
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		after, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid after (must be the seq of an audit entry)"})
+			return
+		}
+	}
+
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid since (must be an RFC 3339 timestamp)"})
+			return
+		}
+	}
+
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditEntries {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid limit (must be between 1 and %d)", maxAuditEntries)})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getAuditEntries(after, since, limit))
+}
+
+// API handler to stream GPU information as server-sent events
+func streamGPUsHandler(w http.ResponseWriter, r *http.Request) {
+	interval := time.Duration(currentConfig().StreamInterval)
+	if interval <= 0 {
+		interval = defaultStreamInterval
+	}
+
+	// The refresh goroutine stops when the client goes away or a write fails,
+	// and the handler waits for it so nothing outlives the request
+	ctx, cancel := context.WithCancel(r.Context())
+	updates := make(chan []GPUInfo)
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		streamRefreshLoop(ctx, interval, updates)
+	}()
+	defer func() {
+		cancel()
+		<-refreshDone
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Streams outlive the server write timeout
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		logError("Stream: Failed to clear write deadline: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case gpus := <-updates:
+			data, err := marshalGPUJSON(gpus)
+			if err != nil {
+				logError("Stream: Failed to encode GPU information: %v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				logInfo("Stream: Client %s disconnected: %v", r.RemoteAddr, err)
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				logInfo("Stream: Client %s disconnected: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
+
+// Send GPU information to a stream connection at a fixed interval until the context is done
+func streamRefreshLoop(ctx context.Context, interval time.Duration, updates chan<- []GPUInfo) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		gpus, _, err := getCachedGPUs()
+		if err != nil {
+			logError("Stream: Failed to refresh GPU information: %v", err)
+		} else {
+			select {
+			case updates <- gpus:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// API handler to set power limits
+func setPowerLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	var request PowerLimitRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	if err := validatePercentOf(request.PercentOf); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := validateClampPolicy(request.ClampPolicy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if request.Ramp != nil {
+		if err := validateRamp(*request.Ramp); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	if request.Async {
+		entry, _ := r.Context().Value(apiKeyContextKey{}).(APIKeyEntry)
+		job := startJob(entry.Label, func(w http.ResponseWriter) { applyPowerLimitRequest(w, request) })
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/jobs/"+job)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobId": job})
+		return
+	}
+
+	applyPowerLimitRequest(w, request)
+}
+
+// Set the limits of a request's GPUs, skipping the ones skip selects, and return
+// the results in index order with the first error. Ramped changes run on every
+// GPU at once, so the request takes one ramp duration instead of one per GPU.
+func setRequestLimits(indices []int, skip skipOptions, ramp *RampOptions, set func(int) (GPUInfo, error)) ([]GPUInfo, error) {
+	results := make([]GPUInfo, len(indices))
+	errs := make([]error, len(indices))
+	apply := func(n int) {
+		index := indices[n]
+		if skippedInfo, skipped := shouldSkipGPU(index, skip); skipped {
+			logInfo("GPU %d: Skipped, %s", index, skippedInfo.SkipReason)
+			results[n] = skippedInfo
+			return
+		}
+		results[n], errs[n] = set(index)
+	}
+
+	if ramp != nil && ramp.Steps > 1 {
+		var wg sync.WaitGroup
+		for n := range indices {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				apply(n)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for n := range indices {
+			apply(n)
+		}
+	}
+
+	var updatedGPUs []GPUInfo
+	var firstErr error
+	for n, index := range indices {
+		if errs[n] != nil {
+			logError("GPU %d: Failed to set power limit: %v", index, errs[n])
+			if firstErr == nil {
+				firstErr = errs[n]
+			}
+			continue
+		}
+		updatedGPUs = append(updatedGPUs, results[n])
+	}
+	return updatedGPUs, firstErr
+}
+
+// Check that a ramp has a usable number of steps and duration
+func validateRamp(ramp RampOptions) error {
+	if ramp.Steps < 1 || ramp.Steps > maxRampSteps {
+		return fmt.Errorf("invalid ramp steps: %d (must be between 1 and %d)", ramp.Steps, maxRampSteps)
+	}
+	if ramp.DurationMs < 0 || ramp.DurationMs > maxRampDurationMs {
+		return fmt.Errorf("invalid ramp durationMs: %d (must be between 0 and %d)", ramp.DurationMs, maxRampDurationMs)
+	}
+	return nil
+}
+
+// Apply a decoded power limit request and write the response
+func applyPowerLimitRequest(w http.ResponseWriter, request PowerLimitRequest) {
+	// Get number of GPUs
+	count, ret := deviceCount()
+	if ret != nvml.SUCCESS {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to get device count: %v", nvml.ErrorString(ret))})
+		return
+	}
+
+	// Process based on mode
+	var updatedGPUs []GPUInfo
+	var firstErr error
+	skip := skipOptions{busyThreshold: request.BusyThreshold, skipBusy: request.SkipBusyGPUs}
+
+	if request.Mode == "all" || request.Mode == "headroom" {
+		// Set the same power limit (or headroom) for all GPUs
+		value := allGPUsValue(request.Mode, request.PowerLimit, request.PowerPercent, request.HeadroomWatts)
+		opts := resolveRequestOptions(request.Strict, request.DryRun, request.ClampPolicy)
+		opts.ramp = request.Ramp
+		var indices []int
+		for i := 0; i < count; i++ {
+			if isGPUVisible(i) {
+				indices = append(indices, i)
+			}
+		}
+		updatedGPUs, firstErr = setRequestLimits(indices, skip, opts.ramp, func(i int) (GPUInfo, error) {
+			return setPowerLimitValue(i, value, request.PercentOf, opts)
+		})
+	} else if request.Mode == "manual" {
+		// Refuse the whole request if it targets a GPU this process may not touch
+		for gpuIndex := range request.ManualLimits {
+			if !isGPUVisible(gpuIndex) {
+				writeError(w, fmt.Errorf("%w: GPU %d", ErrNotVisible, gpuIndex))
+				return
+			}
+		}
+
+		// All-or-nothing requests are checked up front instead of being clamped or skipped
+		if request.Atomic {
+			if err := validateManualLimits(request.ManualLimits, count); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		// Set specific power limits for specified GPUs
+		var indices []int
+		var missingErr error
+		for _, gpuIndex := range sortedGPUIndices(request.ManualLimits) {
+			if gpuIndex >= 0 && gpuIndex < count {
+				indices = append(indices, gpuIndex)
+			} else {
+				logWarning("Warning: GPU %d specified in request doesn't exist", gpuIndex)
+				if missingErr == nil {
+					missingErr = fmt.Errorf("%w: GPU index %d (found %d GPUs)", ErrOutOfRange, gpuIndex, count)
+				}
+			}
+		}
+		opts := resolveRequestOptions(request.Strict, request.DryRun, request.ClampPolicy)
+		opts.ramp = request.Ramp
+		updatedGPUs, firstErr = setRequestLimits(indices, skip, opts.ramp, func(gpuIndex int) (GPUInfo, error) {
+			return setPowerLimit(gpuIndex, request.ManualLimits[gpuIndex], opts)
+		})
+		if firstErr == nil {
+			firstErr = missingErr
+		}
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid mode (must be 'all', 'manual' or 'headroom')"})
+		return
+	}
+
+	// Update the GPU cache with new information
+	if err := refreshGPUCache(); err != nil {
+		logWarning("Warning: Failed to refresh GPU cache: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Report the failure if nothing could be applied
+	if len(updatedGPUs) == 0 && firstErr != nil {
+		writeError(w, firstErr)
+		return
+	}
+
+	writeGPUJSON(w, updatedGPUs)
+}
+
+// API handler to set the power limit of every GPU in a config group
+func setGroupPowerHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	group, ok := currentConfig().Groups[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Group %s not found", name)})
+		return
+	}
+
+	// The body is optional, without one the group default is applied. Fields of
+	// POST /api/power that groups don't support, such as atomic, are refused
+	// instead of being ignored.
+	var request GroupPowerRequest
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			message := "Invalid request format"
+			if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+				message = fmt.Sprintf("Unsupported field for group requests: %s", strings.Trim(field, `"`))
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": message})
+			return
+		}
+	}
+	if err := validatePercentOf(request.PercentOf); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := validateClampPolicy(request.ClampPolicy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if request.Ramp != nil {
+		if err := validateRamp(*request.Ramp); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	value := limitValue{watts: request.PowerLimit, percent: request.PowerPercent}
+	if value.watts == 0 && value.percent == 0 {
+		if group.PowerLimit == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Group %s has no default power limit, set powerLimit", name)})
+			return
+		}
+		value.watts = group.PowerLimit
+	}
+
+	// Refuse the whole request if the group has a GPU this process may not touch
+	for _, gpuIndex := range group.Indices {
+		if !isGPUVisible(gpuIndex) {
+			writeError(w, fmt.Errorf("%w: GPU %d", ErrNotVisible, gpuIndex))
+			return
+		}
+	}
+
+	// Apply like POST /api/power does, in index order
+	indices := slices.Clone(group.Indices)
+	slices.Sort(indices)
+	indices = slices.Compact(indices)
+	opts := resolveRequestOptions(request.Strict, request.DryRun, request.ClampPolicy)
+	opts.ramp = request.Ramp
+	updatedGPUs, firstErr := setRequestLimits(indices, skipOptions{}, opts.ramp, func(gpuIndex int) (GPUInfo, error) {
+		return setPowerLimitValue(gpuIndex, value, request.PercentOf, opts)
+	})
+
+	// Update the GPU cache with new information
+	if err := refreshGPUCache(); err != nil {
+		logWarning("Warning: Failed to refresh GPU cache: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Report the failure if nothing could be applied
+	if len(updatedGPUs) == 0 && firstErr != nil {
+		writeError(w, firstErr)
+		return
+	}
+
+	writeGPUJSON(w, updatedGPUs)
+}
+
+// Check that every GPU in a manual request exists, supports power management
+// and accepts its limit without clamping, including to policyMaxWatts
+func validateManualLimits(limits map[int]uint32, count int) error {
+	configMutex.RLock()
+	maxWatts := policyMaxWatts
+	configMutex.RUnlock()
+
+	for _, gpuIndex := range sortedGPUIndices(limits) {
+		powerLimit := limits[gpuIndex]
+		if gpuIndex < 0 || gpuIndex >= count {
+			return fmt.Errorf("%w: GPU index %d (found %d GPUs)", ErrOutOfRange, gpuIndex, count)
+		}
+
+		gpuInfo, err := getGPUInfo(gpuIndex)
+		if err != nil {
+			return err
+		}
+		if !gpuInfo.Supported {
+			return fmt.Errorf("%w: GPU %d", ErrPowerMgmtUnsupported, gpuIndex)
+		}
+		if powerLimit < gpuInfo.MinLimit || powerLimit > gpuInfo.MaxLimit {
+			return fmt.Errorf("%w: GPU %d limit %d W (allowed %d-%d W)",
+				ErrOutOfRange, gpuIndex, powerLimit, gpuInfo.MinLimit, gpuInfo.MaxLimit)
+		}
+		if maxWatts > 0 && powerLimit > maxWatts {
+			return fmt.Errorf("%w: GPU %d limit %d W is above the policy maximum %d W",
+				ErrOutOfRange, gpuIndex, powerLimit, maxWatts)
+		}
+	}
+	return nil
+}
+
+// Parse the GPU index from the request path and check that the GPU exists.
+// Writes an error response and returns false if the index is invalid.
+func gpuIndexFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid GPU index"})
+		return -1, false
+	}
+
+	count, ret := deviceCount()
+	if ret != nvml.SUCCESS {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to get device count: %v", nvml.ErrorString(ret))})
+		return -1, false
+	}
+
+	if index < 0 || index >= count {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "GPU index out of range"})
+		return -1, false
+	}
+
+	if !isGPUVisible(index) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "GPU not visible"})
+		return -1, false
+	}
+
+	return index, true
+}
+
+// Write the result of a locked clocks operation
+func writeLockedClocksResponse(w http.ResponseWriter, info LockedClocksInfo, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		writeFeatureError(w, err, info.Supported)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// Get the supported memory clocks of a specific GPU with the graphics clocks
+// supported at each one, highest first
+func getSupportedClocks(index int) (SupportedClocksInfo, error) {
+	info := SupportedClocksInfo{Index: index, MemoryClocks: []SupportedMemoryClock{}, Supported: true}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	memoryClocks, ret := supportedMemoryClocks(device)
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		info.Supported = false
+		return info, fmt.Errorf("supported clocks query %w", ErrNotSupported)
+	}
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get supported memory clocks", ret)
+	}
+	sort.Slice(memoryClocks, func(i, j int) bool { return memoryClocks[i] > memoryClocks[j] })
+
+	for _, memoryClock := range memoryClocks {
+		graphicsClocks, ret := supportedGraphicsClocks(device, memoryClock)
+		if ret != nvml.SUCCESS {
+			return info, nvmlError(fmt.Sprintf("get supported graphics clocks at %d MHz", memoryClock), ret)
+		}
+		sort.Slice(graphicsClocks, func(i, j int) bool { return graphicsClocks[i] > graphicsClocks[j] })
+		info.MemoryClocks = append(info.MemoryClocks, SupportedMemoryClock{MemoryClock: memoryClock, GraphicsClocks: graphicsClocks})
+	}
+	return info, nil
+}
+
+// Read the current, maximum and application clocks of a specific GPU
+func getClocks(index int) (ClocksInfo, error) {
+	info := ClocksInfo{Index: index}
+
+	device, ret := deviceHandle(index)
+	if ret != nvml.SUCCESS {
+		return info, nvmlError("get handle", ret)
+	}
+
+	engines := []struct {
+		clockType nvml.ClockType
+		reading   *ClockReading
+	}{
+		{nvml.CLOCK_SM, &info.SM},
+		{nvml.CLOCK_MEM, &info.Memory},
+		{nvml.CLOCK_VIDEO, &info.Video},
+	}
+	for _, engine := range engines {
+		// Clocks that NVML doesn't report on this GPU are left at 0
+		reads := []struct {
+			name  string
+			read  func(nvml.Device, nvml.ClockType) (uint32, nvml.Return)
+			value *uint32
+		}{
+			{"get clock", nvml.DeviceGetClockInfo, &engine.reading.Current},
+			{"get max clock", nvml.DeviceGetMaxClockInfo, &engine.reading.Max},
+			{"get application clock", nvml.DeviceGetApplicationsClock, &engine.reading.Application},
+		}
+		for _, read := range reads {
+			value, ret := read.read(device, engine.clockType)
+			if ret == nvml.ERROR_NOT_SUPPORTED {
+				continue
+			}
+			if ret != nvml.SUCCESS {
+				return info, nvmlError(read.name, ret)
+			}
+			*read.value = value
+		}
+	}
+	return info, nil
+}
+
+// API handler to get the current clocks of a GPU
+func getClocksHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := getClocks(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// API handler to get the supported clock combinations of a GPU
+func getSupportedClocksHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := getSupportedClocks(index)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		writeFeatureError(w, err, info.Supported)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// API handler to lock a GPU's clocks to a range
+func setLockedClocksHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request LockedClocksRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	if request.MinClock == 0 || request.MaxClock == 0 || request.MinClock > request.MaxClock {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid clock range (minClock and maxClock must be positive and minClock <= maxClock)"})
+		return
+	}
+
+	info, err := setLockedClocks(index, request.MinClock, request.MaxClock)
+	if err != nil {
+		logError("GPU %d: Failed to lock clocks: %v", index, err)
+	} else {
+		logInfo("GPU %d: Clocks locked to %d-%d MHz", index, request.MinClock, request.MaxClock)
+	}
+	writeLockedClocksResponse(w, info, err)
+}
+
+// API handler to enable or disable a GPU's auto-boosted clocks
+func setAutoBoostHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request AutoBoostRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Enabled == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format (expected {\"enabled\": true|false})"})
+		return
+	}
+
+	info, err := setAutoBoost(index, *request.Enabled)
+	if err != nil {
+		logError("GPU %d: Failed to set auto-boost: %v", index, err)
+	} else if info.Enabled {
+		logInfo("GPU %d: Auto-boost enabled", index)
+	} else {
+		logInfo("GPU %d: Auto-boost disabled", index)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		writeFeatureError(w, err, info.Supported)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// API handler to set a GPU's fans to a fixed speed or back to automatic
+func setFanHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request FanRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || (request.Speed == nil && !request.Auto) || (request.Speed != nil && request.Auto) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format (expected {\"speed\": <percent>} or {\"auto\": true})"})
+		return
+	}
+
+	info, err := setFanSpeed(index, request.Speed)
+	if err != nil {
+		logError("GPU %d: Failed to set fan speed: %v", index, err)
+	} else if request.Auto {
+		logInfo("GPU %d: Fans returned to automatic control", index)
+	} else {
+		logInfo("GPU %d: Fans set to %d%%", index, *request.Speed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		writeFeatureError(w, err, info.Supported)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// API handler to reset a GPU's locked clocks
+func resetLockedClocksHandler(w http.ResponseWriter, r *http.Request) {
+	index, ok := gpuIndexFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := resetLockedClocks(index)
+	if err != nil {
+		logError("GPU %d: Failed to reset locked clocks: %v", index, err)
+	} else {
+		logInfo("GPU %d: Locked clocks reset", index)
+	}
+	writeLockedClocksResponse(w, info, err)
+}
+
+// API handler to list API key labels
+func getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeyLabels())
+}
+
+// API handler to add an API key
+func addAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var entry APIKeyEntry
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	apiKeysMutex.Lock()
+	if err := validateAPIKeyEntry(apiKeys, entry); err != nil {
+		apiKeysMutex.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	apiKeys = append(apiKeys, entry)
+	keys := append([]APIKeyEntry(nil), apiKeys...)
+	apiKeysMutex.Unlock()
+
+	logInfo("API key added: %s", entry.Label)
+	if currentConfig().PersistAPIKeys {
+		if err := persistAPIKeys(keys); err != nil {
+			logWarning("Warning: Failed to persist API keys: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKeyLabels())
+}
+
+// API handler to remove an API key
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	label := r.PathValue("label")
+
+	apiKeysMutex.Lock()
+	found := -1
+	admins := 0
+	for i, entry := range apiKeys {
+		if entry.Label == label {
+			found = i
+		}
+		if entry.Admin {
+			admins++
+		}
+	}
+	if found < 0 {
+		apiKeysMutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "API key not found"})
+		return
+	}
+	if apiKeys[found].Admin && admins == 1 {
+		apiKeysMutex.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Cannot remove the last admin API key"})
+		return
+	}
+	apiKeys = append(apiKeys[:found:found], apiKeys[found+1:]...)
+	keys := append([]APIKeyEntry(nil), apiKeys...)
+	apiKeysMutex.Unlock()
+
+	logInfo("API key removed: %s", label)
+	if currentConfig().PersistAPIKeys {
+		if err := persistAPIKeys(keys); err != nil {
+			logWarning("Warning: Failed to persist API keys: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeyLabels())
+}
+
+// Name an NVML event type
+func eventTypeName(eventType uint64) string {
+	switch eventType {
+	case nvml.EventTypeXidCriticalError:
+		return "xid"
+	case nvml.EventTypePState:
+		return "pstate"
+	case nvml.EventTypeClock:
+		return "clock"
+	case nvml.EventTypeSingleBitEccError:
+		return "eccSingleBit"
+	case nvml.EventTypeDoubleBitEccError:
+		return "eccDoubleBit"
+	case nvml.EventTypePowerSourceChange:
+		return "powerSource"
+	default:
+		return fmt.Sprintf("unknown(%d)", eventType)
+	}
+}
+
+// Watch visible GPUs for XID, power state and clock events, logging and
+// recording each one and forwarding it to the webhook if configured
+func monitorEvents(count int) {
+	set, ret := nvml.EventSetCreate()
+	if ret != nvml.SUCCESS {
+		logError("Events: Failed to create event set: %v", nvml.ErrorString(ret))
+		return
+	}
+	defer set.Free()
+
+	wanted := uint64(nvml.EventTypeXidCriticalError | nvml.EventTypePState | nvml.EventTypeClock)
+	registered := 0
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		device, ret := deviceHandle(i)
+		if ret != nvml.SUCCESS {
+			logError("Events: GPU %d: Failed to get handle: %v", i, nvml.ErrorString(ret))
+			continue
+		}
+		supported, ret := nvml.DeviceGetSupportedEventTypes(device)
+		if ret != nvml.SUCCESS || supported&wanted == 0 {
+			logInfo("Events: GPU %d: Event monitoring not supported", i)
+			continue
+		}
+		ret = nvml.DeviceRegisterEvents(device, supported&wanted, set)
+		if ret != nvml.SUCCESS {
+			logError("Events: GPU %d: Failed to register events: %v", i, nvml.ErrorString(ret))
+			continue
+		}
+		registered++
+	}
+	if registered == 0 {
+		logInfo("Events: No GPUs support event monitoring")
+		return
+	}
+	logInfo("Events: Monitoring %d GPU(s)", registered)
+
+	for {
+		data, ret := set.Wait(1000)
+		if ret == nvml.ERROR_TIMEOUT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			logError("Events: Failed to wait for events: %v", nvml.ErrorString(ret))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		index, ret := nvml.DeviceGetIndex(data.Device)
+		if ret != nvml.SUCCESS {
+			index = -1
+		}
+		event := GPUEvent{
+			Timestamp: time.Now(),
+			Index:     index,
+			Type:      eventTypeName(data.EventType),
+			Data:      data.EventData,
+		}
+		if event.Type == "xid" {
+			logWarning("Events: GPU %d: XID %d error", event.Index, event.Data)
+		} else {
+			logInfo("Events: GPU %d: %s event", event.Index, event.Type)
+		}
+		recordEvent(event)
+	}
+}
+
+// Keep an event in the recent events list and forward it to the webhook
+func recordEvent(event GPUEvent) {
+	recentEventsMutex.Lock()
+	recentEvents = append(recentEvents, event)
+	if len(recentEvents) > maxRecentEvents {
+		recentEvents = recentEvents[len(recentEvents)-maxRecentEvents:]
+	}
+	recentEventsMutex.Unlock()
+
+	if url := currentConfig().EventWebhookURL; url != "" {
+		go sendEventWebhook(url, event)
+	}
+}
+
+// POST an event to the webhook URL
+func sendEventWebhook(url string, event GPUEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logError("Events: Failed to encode event for webhook: %v", err)
+		return
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logError("Events: Failed to send webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logWarning("Events: Webhook returned %s", resp.Status)
+	}
+}
+
+// Start the API server
+func startAPIServer() {
+	cfg := currentConfig()
+	// Define API routes
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/info", getInfoHandler)
+	api.HandleFunc("GET /api/gpus", getGPUsHandler)
+	api.HandleFunc("GET /api/gpus/changes", waitGPUChangesHandler)
+	api.HandleFunc("GET /api/gpus/compact", getCompactGPUsHandler)
+	api.HandleFunc("GET /api/gpus/{index}", getGPUHandler)
+	api.HandleFunc("GET /api/gpus/{index}/changes", getGPUChangesHandler)
+	api.HandleFunc("GET /api/gpus/{index}/pending", getGPUPendingHandler)
+	api.HandleFunc("GET /api/gpus/{index}/power/range", getPowerRangeHandler)
+	api.HandleFunc("POST /api/gpus/{index}/power/reset", operation("power", resetPowerLimitHandler))
+	api.HandleFunc("GET /api/stream", streamGPUsHandler)
+	api.HandleFunc("GET /api/events", getEventsHandler)
+	api.HandleFunc("GET /api/audit", getAuditHandler)
+	api.HandleFunc("GET /api/repro", getReproHandler)
+	api.HandleFunc("POST /api/power", operation("power", idempotencyMiddleware(setPowerLimitsHandler)))
+	api.HandleFunc("GET /api/jobs/{id}", getJobHandler)
+	api.HandleFunc("POST /api/groups/{name}/power", operation("power", idempotencyMiddleware(setGroupPowerHandler)))
+	api.HandleFunc("GET /api/gpus/{index}/clocks", getClocksHandler)
+	api.HandleFunc("GET /api/gpus/{index}/clocks/supported", getSupportedClocksHandler)
+	api.HandleFunc("POST /api/gpus/{index}/lockedclocks", operation("lockedClocks", setLockedClocksHandler))
+	api.HandleFunc("POST /api/gpus/{index}/lockedclocks/reset", operation("lockedClocks", resetLockedClocksHandler))
+	api.HandleFunc("PUT /api/gpus/{index}/autoboost", operation("autoBoost", setAutoBoostHandler))
+	api.HandleFunc("PUT /api/gpus/{index}/fan", operation("fan", setFanHandler))
+	api.HandleFunc("GET /api/keys", adminKeyMiddleware(getAPIKeysHandler))
+	api.HandleFunc("POST /api/keys", operation("keys", adminKeyMiddleware(addAPIKeyHandler)))
+	api.HandleFunc("DELETE /api/keys/{label}", operation("keys", adminKeyMiddleware(deleteAPIKeyHandler)))
+
+	// Apply middleware to all API routes, the first one listed runs first
+	var handler http.Handler = api
+	if cfg.MaxConcurrentRequests > 0 {
+		handler = concurrencyLimitMiddleware(cfg.MaxConcurrentRequests)(handler)
+	}
+	handler = nvmlHealthMiddleware(handler)
+	handler = jsonContentTypeMiddleware(handler)
+	handler = apiKeyMiddleware(handler)
+	handler = envelopeMiddleware(handler)
+	handler = requestCountMiddleware(api)(handler)
+
+	router := http.NewServeMux()
+	router.Handle("/api/", handler)
+
+	// Prometheus scrapes without an API key, so metrics live outside /api
+	if cfg.ExposeMetrics {
+		router.HandleFunc("GET /metrics", metricsHandler)
+		logInfo("Serving Prometheus metrics at /metrics")
+	}
+
+	// Serve the dashboard outside /api - it logs in with the API key itself
+	if cfg.ServeDashboard {
+		dashboard, err := fs.Sub(dashboardFiles, "dashboard")
+		if err != nil {
+			logFatal("Failed to load dashboard: %v", err)
+		}
+		router.Handle("/", http.FileServer(http.FS(dashboard)))
+		logInfo("Serving dashboard at /")
+	}
+
+	// Start server, with timeouts so slow clients can't hold connections forever
+	port := cfg.APIPort
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      router,
+		ReadTimeout:  durationOrDefault(cfg.ReadTimeout, defaultReadTimeout),
+		WriteTimeout: durationOrDefault(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:  durationOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
+	}
+
+	// HTTP/2 is negotiated automatically over TLS; plaintext HTTP/2 (h2c) has to be enabled
+	if cfg.HTTP2Cleartext {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	listener, err := listenWithRetry(server.Addr)
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			logFatal("Port %d is still in use after %d attempts, is another instance running? %v", port, listenAttempts, err)
+		}
+		logFatal("%v", err)
+	}
+
+	if cfg.TLSCertFile != "" {
+		logInfo("Starting API server on port %d with TLS", port)
+		logFatal("%v", server.ServeTLS(listener, cfg.TLSCertFile, cfg.TLSKeyFile))
+	}
+	logInfo("Starting API server on port %d", port)
+	logFatal("%v", server.Serve(listener))
+}
+
+// How often binding the API port is tried while it is in use, and the time between tries
+const listenAttempts = 5
+const listenRetryDelay = 2 * time.Second
+
+// Listen on the API port, retrying while it is in use, as it is for a moment
+// when a restarted service starts before the old process has released it
+func listenWithRetry(addr string) (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt == listenAttempts {
+			return listener, err
+		}
+		logWarning("Address %s is in use, retrying in %v (attempt %d of %d)", addr, listenRetryDelay, attempt, listenAttempts)
+		time.Sleep(listenRetryDelay)
+	}
+}
+
+// Get a configured duration, or the default if it isn't set
+func durationOrDefault(value Duration, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return time.Duration(value)
+}
+
+// Whether the config is fetched from a URL instead of read from a file
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Read the raw config from the file or URL in configPath
+func readConfigData() ([]byte, error) {
+	if !isRemoteConfig(configPath) {
+		return ioutil.ReadFile(configPath)
+	}
+
+	data, err := fetchRemoteConfig(configPath)
+	lastRemoteConfigMutex.Lock()
+	defer lastRemoteConfigMutex.Unlock()
+	if err != nil {
+		if lastRemoteConfig == nil {
+			return nil, err
+		}
+		logWarning("Warning: %v, using the last config fetched", err)
+		return lastRemoteConfig, nil
+	}
+	lastRemoteConfig = data
+	return data, nil
+}
+
+// Fetch a config over HTTP, with a bearer token from NVIDIA_POWER_CONFIG_TOKEN if set
+func fetchRemoteConfig(url string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config URL %s: %v", url, err)
+	}
+	if token := os.Getenv("NVIDIA_POWER_CONFIG_TOKEN"); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config from %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config from %s: %v", url, err)
+	}
+	return data, nil
+}
+
+// Load configuration from file
+func loadConfig() (Config, error) {
+	// Set default values
+	config := Config{
+		Mode:           "all",
+		PowerLimit:     250,
+		APIPort:        defaultAPIPort,
+		StartAPIServer: false, // Default to not starting API server
+	}
+
+	// Try to load config file
+	configData, err := readConfigData()
+	if err != nil && isRemoteConfig(configPath) {
+		return config, err
+	} else if err != nil {
+		// Without a file the server can still be configured entirely from the environment
+		if os.Getenv("NVIDIA_POWER_START_API_SERVER") == "" {
+			applyFlagOverrides(&config)
+			return config, fmt.Errorf("%w: %v", errNoConfigFile, err)
+		}
+		config.Mode = "" // Don't apply the default limit unless the environment asks for it
+	} else {
+		// Parse config file
+		err = json.Unmarshal(configData, &config)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse config.json: %v", err)
+		}
+	}
+
+	// Environment variables override the file, and command line options both
+	if err := applyEnvOverrides(&config); err != nil {
+		return config, err
+	}
+	applyFlagOverrides(&config)
+
+	// The list form of the manual limits takes precedence over the map
+	if len(config.GPULimits) > 0 {
+		limits, err := manualLimitsFromList(config.GPULimits)
+		if err != nil {
+			return config, err
+		}
+		config.ManualLimits = limits
+	}
+
+	// Port 0 means the default port
+	if config.APIPort == 0 {
+		config.APIPort = defaultAPIPort
+	}
+	if config.APIPort < 1 || config.APIPort > 65535 {
+		return config, fmt.Errorf("invalid apiPort: %d (must be between 1 and 65535, or 0 for the default %d)",
+			config.APIPort, defaultAPIPort)
+	}
+
+	if err := validatePercentOf(config.PercentOf); err != nil {
+		return config, err
+	}
+
+	if config.SettleDelayMs < 0 {
+		return config, fmt.Errorf("invalid settleDelayMs: %d (must not be negative)", config.SettleDelayMs)
+	}
+
+	if config.SetCooldownMs < 0 {
+		return config, fmt.Errorf("invalid setCooldownMs: %d (must not be negative)", config.SetCooldownMs)
+	}
+
+	if config.FailRate < 0 || config.FailRate > 1 {
+		return config, fmt.Errorf("invalid failRate: %v (must be between 0 and 1)", config.FailRate)
+	}
+
+	if err := validateGroups(config.Groups); err != nil {
+		return config, err
+	}
+
+	if config.ApplyWhenIdle != nil {
+		if config.ApplyWhenIdle.Utilization > 100 {
+			return config, fmt.Errorf("invalid applyWhenIdle utilization: %d (must be a percentage between 0 and 100)", config.ApplyWhenIdle.Utilization)
+		}
+		if config.ApplyWhenIdle.MaxWait < 0 {
+			return config, fmt.Errorf("invalid applyWhenIdle maxWait: %v (must not be negative)", time.Duration(config.ApplyWhenIdle.MaxWait))
+		}
+	}
+
+	if config.ExternalMeterCmd != "" && config.ExternalMeterBudget == 0 {
+		return config, fmt.Errorf("externalMeterCmd needs an externalMeterBudget in watts")
+	}
+
+	if err := validateGPULabels(config.GPULabels); err != nil {
+		return config, err
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return config, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+
+	for _, name := range config.DisabledOperations {
+		if !slices.Contains(operationNames, name) {
+			return config, fmt.Errorf("invalid disabledOperations entry: %s (must be one of %s)", name, strings.Join(operationNames, ", "))
+		}
+	}
+
+	switch config.ClampLogging {
+	case "", "always", "once", "off":
+	default:
+		return config, fmt.Errorf("invalid clampLogging: %s (must be 'always', 'once' or 'off')", config.ClampLogging)
+	}
+
+	switch config.JSONCase {
+	case "", "camel", "snake":
+	default:
+		return config, fmt.Errorf("invalid jsonCase: %s (must be 'camel' or 'snake')", config.JSONCase)
+	}
+
+	switch config.MetricsUnits {
+	case "", "watts", "milliwatts", "both":
+	default:
+		return config, fmt.Errorf("invalid metricsUnits: %s (must be 'watts', 'milliwatts' or 'both')", config.MetricsUnits)
+	}
+
+	return config, nil
+}
+
+// Convert gpuLimits to the manualLimits map, rejecting GPUs listed twice
+func manualLimitsFromList(list []ManualLimit) (map[int]uint32, error) {
+	limits := make(map[int]uint32, len(list))
+	for _, entry := range list {
+		if entry.Index < 0 {
+			return nil, fmt.Errorf("invalid GPU index %d in gpuLimits", entry.Index)
+		}
+		if entry.Watts == 0 {
+			return nil, fmt.Errorf("invalid power limit for GPU %d in gpuLimits (watts must be positive)", entry.Index)
+		}
+		if _, ok := limits[entry.Index]; ok {
+			return nil, fmt.Errorf("GPU %d is listed more than once in gpuLimits", entry.Index)
+		}
+		limits[entry.Index] = entry.Watts
+	}
+	return limits, nil
+}
+
+// Check that group indices are valid and that no GPU is in more than one group
+func validateGroups(groups map[string]GPUGroup) error {
+	members := make(map[int]string)
+	for _, name := range sortedGroupNames(groups) {
+		for _, index := range groups[name].Indices {
+			if index < 0 {
+				return fmt.Errorf("invalid GPU index %d in group %s", index, name)
+			}
+			if other, ok := members[index]; ok {
+				return fmt.Errorf("GPU %d is in both group %s and group %s", index, other, name)
+			}
+			members[index] = name
+		}
+	}
+	return nil
+}
+
+// Prometheus label names, which GPU labels are exported as
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Check that GPU label names can be used as Prometheus labels
+func validateGPULabels(labels map[int]map[string]string) error {
+	for index, gpuLabels := range labels {
+		if index < 0 {
+			return fmt.Errorf("invalid GPU index %d in gpuLabels", index)
+		}
+		for name := range gpuLabels {
+			if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("invalid label name %q for GPU %d in gpuLabels (must be letters, digits and underscores)", name, index)
+			}
+			if name == "gpu" || name == "name" {
+				return fmt.Errorf("invalid label name %q for GPU %d in gpuLabels (reserved for /metrics)", name, index)
+			}
+		}
+	}
+	return nil
+}
+
+// Map each grouped GPU index to its group name
+func groupMembership(groups map[string]GPUGroup) map[int]string {
+	members := make(map[int]string)
+	for name, group := range groups {
+		for _, index := range group.Indices {
+			members[index] = name
+		}
+	}
+	return members
+}
+
+// Get the group names in a stable order
+func sortedGroupNames(groups map[string]GPUGroup) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Override config fields from --api-key and --api-port
+func applyFlagOverrides(config *Config) {
+	if apiKeyOverride != "" {
+		config.APIKey = apiKeyOverride
+	}
+	if apiPortOverride != 0 {
+		config.APIPort = apiPortOverride
+	}
+}
+
+// Override config fields from NVIDIA_POWER_* environment variables
+func applyEnvOverrides(config *Config) error {
+	if value := os.Getenv("NVIDIA_POWER_MODE"); value != "" {
+		config.Mode = value
+	}
+	if value := os.Getenv("NVIDIA_POWER_LIMIT"); value != "" {
+		limit, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid NVIDIA_POWER_LIMIT: %s", value)
+		}
+		config.PowerLimit = uint32(limit)
+		if config.Mode == "" {
+			config.Mode = "all"
+		}
+	}
+	if value := os.Getenv("NVIDIA_POWER_API_KEY"); value != "" {
+		config.APIKey = value
+	}
+	if value := os.Getenv("NVIDIA_POWER_API_PORT"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid NVIDIA_POWER_API_PORT: %s", value)
+		}
+		config.APIPort = port
+	}
+	if value := os.Getenv("NVIDIA_POWER_START_API_SERVER"); value != "" {
+		start, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid NVIDIA_POWER_START_API_SERVER: %s", value)
+		}
+		config.StartAPIServer = start
+	}
+	return nil
+}
+
+// Get the GPU indices of a manual limits map in ascending order, so results
+// come out in a predictable order
+func sortedGPUIndices(limits map[int]uint32) []int {
+	indices := make([]int, 0, len(limits))
+	for gpuIndex := range limits {
+		indices = append(indices, gpuIndex)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Apply power settings from config
+func applyConfigSettings(config Config, count int) error {
+	// With atomicApply, remember the limits so a partial failure can be undone
+	var priorLimits map[int]uint32
+	if config.AtomicApply {
+		priorLimits = recordOriginalLimits(count)
+	}
+	var changed, failedGPUs []int
+	missing := 0
+	apply := func(index int, gpuInfo GPUInfo, err error) {
+		if err != nil {
+			fmt.Printf("GPU %d: Failed to set power limit: %v\n", index, err)
+			// GPUs that can't be power limited at all don't make the config fail
+			if !errors.Is(err, ErrPowerMgmtUnsupported) {
+				failedGPUs = append(failedGPUs, index)
+			}
+			return
+		}
+		fmt.Printf("GPU %d (%s): Power limit %s\n",
+			gpuInfo.Index, gpuInfo.Name, describeResult(gpuInfo))
+		if gpuInfo.Unchanged || gpuInfo.DryRun || !config.AtomicApply {
+			return
+		}
+		// Without a recorded limit there is nothing to roll back to
+		if _, ok := priorLimits[index]; !ok {
+			fmt.Printf("Warning: GPU %d had no readable power limit before the change, it can't be rolled back\n", index)
+			return
+		}
+		changed = append(changed, index)
+	}
+
+	if config.Mode == "all" || config.Mode == "headroom" {
+		// Apply same power limit (or headroom) to all GPUs
+		value := allGPUsValue(config.Mode, config.PowerLimit, config.PowerPercent, config.HeadroomWatts)
+		fmt.Printf("Setting all GPUs to %s\n", describeLimit(value, config.PercentOf))
+		for i := 0; i < count; i++ {
+			if !isGPUVisible(i) {
+				continue
+			}
+			gpuInfo, err := setPowerLimitValue(i, value, config.PercentOf, resolveApplyOptions("config", nil, nil))
+			apply(i, gpuInfo, err)
+		}
+	} else if config.Mode == "manual" {
+		// Apply specific power limits
+		for _, gpuIndex := range sortedGPUIndices(config.ManualLimits) {
+			powerLimit := config.ManualLimits[gpuIndex]
+			if gpuIndex >= 0 && gpuIndex < count {
+				gpuInfo, err := setPowerLimit(gpuIndex, powerLimit, resolveApplyOptions("config", nil, nil))
+				apply(gpuIndex, gpuInfo, err)
+			} else {
+				fmt.Printf("Warning: GPU %d specified in config doesn't exist\n", gpuIndex)
+				missing++
+			}
+		}
+	} else {
+		fmt.Printf("Invalid mode in config: %s (must be 'all', 'manual' or 'headroom')\n", config.Mode)
+	}
+
+	// GPUs that weren't ready yet, as at boot, get more chances until the deadline
+	if retryFor := time.Duration(config.RetryApplyUntilComplete); retryFor > 0 && len(failedGPUs) > 0 {
+		targets := configTargets(config, count)
+		deadline := time.Now().Add(retryFor)
+		for len(failedGPUs) > 0 && time.Now().Before(deadline) {
+			wait := min(applyRetryInterval, time.Until(deadline))
+			logWarning("Retrying %d GPU(s) in %v, giving up in %v",
+				len(failedGPUs), wait.Round(time.Second), time.Until(deadline).Round(time.Second))
+			time.Sleep(wait)
+
+			retry := failedGPUs
+			failedGPUs = nil
+			for _, index := range retry {
+				gpuInfo, err := setPowerLimitValue(index, targets[index], config.PercentOf, resolveApplyOptions("config", nil, nil))
+				apply(index, gpuInfo, err)
+			}
+		}
+		if len(failedGPUs) > 0 {
+			logError("Gave up on %d GPU(s) after %v", len(failedGPUs), retryFor)
+		} else {
+			logInfo("All GPUs applied")
+		}
+	}
+	failed := len(failedGPUs) + missing
+
+	// Put back the limits that were changed before reporting the failure
+	if config.AtomicApply && failed > 0 {
+		for _, index := range changed {
+			gpuInfo, err := setPowerLimit(index, priorLimits[index], applyOptions{source: "rollback", rollback: true})
+			if err != nil {
+				fmt.Printf("GPU %d: Failed to roll back power limit: %v\n", index, err)
+				continue
+			}
+			fmt.Printf("GPU %d (%s): Power limit rolled back to %d W\n", gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
+		}
+		return fmt.Errorf("%d GPU(s) failed, config not applied (atomicApply)", failed)
+	}
+
+	applyGroupLimits(config, count)
+	return nil
+}
+
+// Apply the default limit of each config group to its members, on top of the mode settings
+func applyGroupLimits(config Config, count int) {
+	for _, name := range sortedGroupNames(config.Groups) {
+		group := config.Groups[name]
+		if group.PowerLimit == 0 {
+			continue
+		}
+		fmt.Printf("Setting group %s to %d W\n", name, group.PowerLimit)
+		for _, gpuIndex := range group.Indices {
+			if gpuIndex >= count {
+				fmt.Printf("Warning: GPU %d in group %s doesn't exist\n", gpuIndex, name)
+				continue
+			}
+			if !isGPUVisible(gpuIndex) {
+				continue
+			}
+			gpuInfo, err := setPowerLimit(gpuIndex, group.PowerLimit, resolveApplyOptions("config", nil, nil))
+			if err != nil {
+				fmt.Printf("GPU %d: Failed to set power limit: %v\n", gpuIndex, err)
+				continue
+			}
+			fmt.Printf("GPU %d (%s): Power limit %s\n",
+				gpuInfo.Index, gpuInfo.Name, describeResult(gpuInfo))
+		}
+	}
+}
+
+// Name a Windows driver model the way nvidia-smi does
+func driverModelName(model nvml.DriverModel) string {
+	switch model {
+	case nvml.DRIVER_WDDM:
+		return "WDDM"
+	case nvml.DRIVER_WDM:
+		return "TCC"
+	default:
+		return fmt.Sprintf("Unknown (%d)", model)
+	}
+}
+
+// Get power usage as a percentage of the limit, to one decimal place
+func powerPercent(usage, limit uint32) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return math.Round(float64(usage)*1000/float64(limit)) / 10
+}
+
+// Print a table of GPUs with their power usage and limits
+func printGPUList(count int) {
+	fmt.Printf("%-4s %-32s %8s %8s %7s %13s %6s\n", "GPU", "Name", "Usage", "Limit", "OfLimit", "Range", "Util")
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			fmt.Printf("%-4d %-32s failed to read: %v\n", i, gpuInfo.Name, err)
+			continue
+		}
+		if !gpuInfo.Supported {
+			fmt.Printf("%-4d %-32s power management not supported\n", i, gpuInfo.Name)
+			continue
+		}
+		fmt.Printf("%-4d %-32s %6d W %6d W %6.1f%% %5d-%4d W %5d%%\n",
+			i, gpuInfo.Name, gpuInfo.PowerUsage, gpuInfo.PowerLimit, gpuInfo.PowerPercent,
+			gpuInfo.MinLimit, gpuInfo.MaxLimit, gpuInfo.Utilization)
+	}
+}
+
+// Iterations per GPU for --bench unless --iterations is given
+const defaultBenchIterations = 20
+
+// Get the minimum, average and 99th percentile of latencies
+func latencyStats(latencies []time.Duration) (time.Duration, time.Duration, time.Duration) {
+	if len(latencies) == 0 {
+		return 0, 0, 0
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+	p99 := sorted[int(math.Ceil(float64(len(sorted))*0.99))-1]
+	return sorted[0], total / time.Duration(len(sorted)), p99
+}
+
+// Print latency stats for one kind of operation
+func printLatencyStats(operation string, latencies []time.Duration) {
+	minimum, average, p99 := latencyStats(latencies)
+	fmt.Printf("  %-4s min %-10v avg %-10v p99 %v\n", operation, minimum.Round(time.Microsecond),
+		average.Round(time.Microsecond), p99.Round(time.Microsecond))
+}
+
+// Time getGPUInfo and setPowerLimit on each GPU, alternating the limit by
+// one watt so every set reaches NVML, then restore the original limit
+func benchGPUs(count int, iterations int) {
+	opts := applyOptions{source: "bench", benchmark: true}
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			fmt.Printf("GPU %d: Failed to read: %v\n", i, err)
+			continue
+		}
+		fmt.Printf("GPU %d (%s), %d iterations:\n", i, gpuInfo.Name, iterations)
+
+		var gets []time.Duration
+		for n := 0; n < iterations; n++ {
+			start := time.Now()
+			if _, err := getGPUInfo(i); err != nil {
+				fmt.Printf("  get failed: %v\n", err)
+				break
+			}
+			gets = append(gets, time.Since(start))
+		}
+		printLatencyStats("get", gets)
+
+		if !gpuInfo.Supported {
+			fmt.Println("  set  skipped, power management not supported")
+			continue
+		}
+		if gpuInfo.MinLimit == gpuInfo.MaxLimit {
+			fmt.Printf("  set  skipped, power limit is fixed at %d W\n", gpuInfo.MinLimit)
+			continue
+		}
+
+		original := gpuInfo.PowerLimit
+		other := original - 1
+		if original <= gpuInfo.MinLimit {
+			other = original + 1
+		}
+		var sets []time.Duration
+		for n := 0; n < iterations; n++ {
+			target := other
+			if n%2 == 1 {
+				target = original
+			}
+			start := time.Now()
+			if _, err := setPowerLimit(i, target, opts); err != nil {
+				fmt.Printf("  set failed: %v\n", err)
+				break
+			}
+			sets = append(sets, time.Since(start))
+		}
+		printLatencyStats("set", sets)
+
+		if _, err := setPowerLimit(i, original, opts); err != nil {
+			fmt.Printf("  Failed to restore power limit %d W: %v\n", original, err)
+		}
+	}
+}
+
+// Redraw the GPU list at a fixed interval until SIGINT or SIGTERM
+func watchGPUList(count int, interval time.Duration) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fmt.Print("\033[H\033[2J") // Clear the screen
+		fmt.Printf("Every %v: nvidia-power-control --list    %s\n\n", interval, time.Now().Format("15:04:05"))
+		printGPUList(count)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Append a row per GPU with its power usage, limit and temperature to a CSV
+// file at a fixed interval until SIGINT or SIGTERM. A new file gets a header.
+func logPowerCSV(path string, count int, interval time.Duration) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if stat, err := file.Stat(); err == nil && stat.Size() == 0 {
+		writer.Write([]string{"timestamp", "index", "powerUsage", "powerLimit", "temperature"})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fmt.Printf("Logging power to %s every %v, press Ctrl-C to stop\n", path, interval)
+	for {
+		timestamp := time.Now().UTC().Format(time.RFC3339)
+		for i := 0; i < count; i++ {
+			if !isGPUVisible(i) {
+				continue
+			}
+			gpuInfo, err := getGPUInfo(i)
+			if err != nil {
+				fmt.Printf("GPU %d: Failed to read power: %v\n", i, err)
+				continue
+			}
+			writer.Write([]string{
+				timestamp,
+				strconv.Itoa(gpuInfo.Index),
+				strconv.FormatUint(uint64(gpuInfo.PowerUsage), 10),
+				strconv.FormatUint(uint64(gpuInfo.PowerLimit), 10),
+				strconv.FormatUint(uint64(gpuInfo.Temperature), 10),
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Print a summary of each GPU and whether it supports power management
+func printGPUSummary(count int) {
+	fmt.Printf("Detected %d GPU(s):\n", count)
+	unsupported := 0
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			fmt.Printf("  GPU %d: not visible (NVIDIA_POWER_VISIBLE)\n", i)
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			unsupported++
+			fmt.Printf("  GPU %d (%s): power management status unknown: %v\n", i, gpuInfo.Name, err)
+			continue
+		}
+		if !gpuInfo.Supported {
+			unsupported++
+			fmt.Printf("  GPU %d (%s): power management NOT supported\n", i, gpuInfo.Name)
+			continue
+		}
+		fmt.Printf("  GPU %d (%s): power management supported (%d-%d W, current %d W)\n",
+			i, gpuInfo.Name, gpuInfo.MinLimit, gpuInfo.MaxLimit, gpuInfo.PowerLimit)
+	}
+	if unsupported > 0 {
+		fmt.Printf("Warning: %d of %d GPU(s) cannot be power limited\n", unsupported, count)
+	}
+}
+
+// NVML features probed at startup, with a read-only call that exercises each
+var driverFeatures = []struct {
+	name  string
+	probe func(device nvml.Device) nvml.Return
+}{
+	{"power limits", func(device nvml.Device) nvml.Return {
+		_, _, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
+		return ret
+	}},
+	{"enforced power limit", func(device nvml.Device) nvml.Return {
+		_, ret := nvml.DeviceGetEnforcedPowerLimit(device)
+		return ret
+	}},
+	{"power usage", func(device nvml.Device) nvml.Return {
+		_, ret := nvml.DeviceGetPowerUsage(device)
+		return ret
+	}},
+	{"temperature thresholds", func(device nvml.Device) nvml.Return {
+		_, ret := nvml.DeviceGetTemperatureThreshold(device, nvml.TEMPERATURE_THRESHOLD_SLOWDOWN)
+		return ret
+	}},
+	{"module power", func(device nvml.Device) nvml.Return {
+		return nvml.DeviceGetFieldValues(device, []nvml.FieldValue{{FieldId: nvml.FI_DEV_POWER_INSTANT, ScopeId: nvml.POWER_SCOPE_MODULE}})
+	}},
+	{"remapped rows", func(device nvml.Device) nvml.Return {
+		_, _, _, _, ret := nvml.DeviceGetRemappedRows(device)
+		return ret
+	}},
+}
+
+// Print which features the running driver provides, probed on the first visible GPU
+func printDriverCompatibility(count int) {
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		device, ret := deviceHandle(i)
+		if ret != nvml.SUCCESS {
+			return
+		}
+
+		var tooOld []string
+		for _, feature := range driverFeatures {
+			if feature.probe(device) == nvml.ERROR_FUNCTION_NOT_FOUND {
+				tooOld = append(tooOld, feature.name)
+			}
+		}
+
+		version, ret := nvml.SystemGetDriverVersion()
+		if ret != nvml.SUCCESS {
+			version = "unknown"
+		}
+		if len(tooOld) == 0 {
+			fmt.Printf("Driver %s: all features available\n", version)
+		} else {
+			fmt.Printf("Driver %s is too old for: %s\n", version, strings.Join(tooOld, ", "))
+		}
+		return
+	}
+}
+
+// Get the power limit the config wants for each GPU
+func configTargets(config Config, count int) map[int]limitValue {
+	targets := make(map[int]limitValue)
+	switch config.Mode {
+	case "all", "headroom":
+		for i := 0; i < count; i++ {
+			if isGPUVisible(i) {
+				targets[i] = allGPUsValue(config.Mode, config.PowerLimit, config.PowerPercent, config.HeadroomWatts)
+			}
+		}
+	case "manual":
+		for gpuIndex, powerLimit := range config.ManualLimits {
+			if gpuIndex >= 0 && gpuIndex < count && isGPUVisible(gpuIndex) {
+				targets[gpuIndex] = limitValue{watts: powerLimit}
+			}
+		}
+	}
+
+	// Group defaults take precedence over the mode settings
+	for _, group := range config.Groups {
+		if group.PowerLimit == 0 {
+			continue
+		}
+		for _, gpuIndex := range group.Indices {
+			if gpuIndex < count && isGPUVisible(gpuIndex) {
+				targets[gpuIndex] = limitValue{watts: group.PowerLimit}
+			}
+		}
+	}
+	return targets
+}
+
+// Re-apply the config limits, logging only GPUs whose limit had drifted
+func enforceConfigSettings(config Config, count int) {
+	for gpuIndex, value := range configTargets(config, count) {
+		before, err := getGPUInfo(gpuIndex)
+		if err != nil {
+			logError("Enforce: GPU %d: Failed to read power limit: %v", gpuIndex, err)
+			continue
+		}
+
+		gpuInfo, err := setPowerLimitValue(gpuIndex, value, config.PercentOf, resolveApplyOptions("enforce", nil, nil))
+		if err != nil {
+			logError("Enforce: GPU %d: Failed to set power limit: %v", gpuIndex, err)
+			continue
+		}
+		if gpuInfo.PowerLimit != before.PowerLimit {
+			logInfo("Enforce: GPU %d (%s): Power limit restored from %d W to %d W",
+				gpuInfo.Index, gpuInfo.Name, before.PowerLimit, gpuInfo.PowerLimit)
+		}
+	}
+}
+
+// Re-apply the config limits at a fixed interval until the stop channel receives
+func runEnforcementLoop(count int, interval time.Duration, stop <-chan os.Signal) {
+	logInfo("Enforcing power limits every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	paused := false
+	for {
+		select {
+		case sig := <-stop:
+			logInfo("Received %v, stopping enforcement", sig)
+			return
+		case <-ticker.C:
+			// A held budget takes precedence over the config limits
+			if holders := heldBudgets(); len(holders) > 0 {
+				if !paused {
+					logInfo("Enforce: Paused while %s holds the power limits", strings.Join(holders, " and "))
+					paused = true
+				}
+				continue
+			}
+			if paused {
+				logInfo("Enforce: Resumed")
+				paused = false
+			}
+			enforceConfigSettings(currentConfig(), count)
+		}
+	}
+}
+
+// Record the current power limit of every visible GPU that supports power management
+func recordOriginalLimits(count int) map[int]uint32 {
+	limits := make(map[int]uint32)
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			logError("GPU %d: Failed to read power limit, it won't be restored: %v", i, err)
+			continue
+		}
+		if gpuInfo.Supported {
+			limits[i] = gpuInfo.PowerLimit
+		}
+	}
+	return limits
+}
+
+// Re-apply the power limits recorded earlier, at startup or before throttling.
+// Restores are never held back by setCooldown.
+func restoreOriginalLimits(limits map[int]uint32, count int) {
+	for i := 0; i < count; i++ {
+		limit, ok := limits[i]
+		if !ok {
+			continue
+		}
+		gpuInfo, err := setPowerLimit(i, limit, applyOptions{source: "restore", rollback: true})
+		if err != nil {
+			fmt.Printf("GPU %d: Failed to restore power limit: %v\n", i, err)
+			continue
+		}
+		fmt.Printf("GPU %d (%s): Power limit restored to %d W\n", gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
+	}
+}
+
+// Block until SIGINT or SIGTERM, then restore the power limits recorded at startup
+func waitAndRestore(limits map[int]uint32, count int) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	signal.Stop(stop)
+
+	fmt.Printf("Received %v, restoring original power limits\n", sig)
+	restoreOriginalLimits(limits, count)
+}
+
+// Set the globals that config fields control, at startup and on reload. They are
+// guarded by configMutex like config itself.
+func applyRuntimeSettings(cfg Config) {
+	configMutex.Lock()
+	policyMaxWatts = cfg.PolicyMaxWatts
+	sysfsFallback = cfg.SysfsFallback
+	gpuGroups = groupMembership(cfg.Groups)
+	gpuLabels = cfg.GPULabels
+	clampLogging = cfg.ClampLogging
+	jsonCase = cfg.JSONCase
+	setCooldown = time.Duration(cfg.SetCooldownMs) * time.Millisecond
+	settleDelay = time.Duration(cfg.SettleDelayMs) * time.Millisecond
+	configMutex.Unlock()
+
+	nvmlBreaker.mutex.Lock()
+	nvmlBreaker.threshold = defaultNVMLFailureThreshold
+	if cfg.NVMLFailureThreshold > 0 {
+		nvmlBreaker.threshold = cfg.NVMLFailureThreshold
+	}
+	nvmlBreaker.cooldown = durationOrDefault(cfg.NVMLCooldown, defaultNVMLCooldown)
+	nvmlBreaker.mutex.Unlock()
+}
+
+// Time to wait for more changes to the config file before reloading, since
+// editors often write a file in several steps
+const configReloadDebounce = 500 * time.Millisecond
+
+// Guards config while a reload replaces it
+var configMutex sync.RWMutex
+
+// Get the config currently in effect
+func currentConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// Put a config into effect, along with the globals its fields control
+func setCurrentConfig(cfg Config) {
+	configMutex.Lock()
+	config = cfg
+	configMutex.Unlock()
+	applyRuntimeSettings(cfg)
+}
+
+// Load the config file again and apply it, keeping the current config if the new one is invalid
+func reloadConfig(count int) {
+	cfg, err := loadConfig()
+	if err != nil {
+		logError("Config reload failed, keeping the current config: %v", err)
+		return
+	}
+	if cfg.StartAPIServer && cfg.APIKey == "" && len(cfg.APIKeys) == 0 {
+		logError("Config reload failed, keeping the current config: API key is required to start API server")
+		return
+	}
+	if cfg.StartAPIServer {
+		if err := initAPIKeys(cfg); err != nil {
+			logError("Config reload failed, keeping the current config: %v", err)
+			return
+		}
+	}
+
+	if cfg.ApplyWhenIdle != nil {
+		waitForIdleGPUs(*cfg.ApplyWhenIdle, count)
+	}
+
+	setCurrentConfig(cfg)
+
+	// A held budget takes precedence over the config limits, as in enforcement
+	if holders := heldBudgets(); len(holders) > 0 {
+		logInfo("Config reloaded from %s, limits left alone while %s holds them", configPath, strings.Join(holders, " and "))
+		return
+	}
+
+	if cfg.Mode == "" {
+		applyGroupLimits(cfg, count)
+	} else if err := applyConfigSettings(cfg, count); err != nil {
+		logError("Config reloaded, but applying it failed: %v", err)
+		return
+	}
+	if err := refreshGPUCache(); err != nil {
+		logWarning("Warning: Failed to refresh GPU cache: %v", err)
+	}
+	logInfo("Config reloaded from %s", configPath)
 }
 
-// Global variables for API access
-var gpuCache []GPUInfo
-var config Config
+// Wait until every visible GPU is below the idle utilization, or until maxWait has passed
+func waitForIdleGPUs(idle IdleWait, count int) {
+	threshold := idle.Utilization
+	if threshold == 0 {
+		threshold = defaultIdleUtilization
+	}
+	maxWait := durationOrDefault(idle.MaxWait, defaultIdleMaxWait)
+	deadline := time.Now().Add(maxWait)
 
-// Print help information
-func printHelp() {
-	fmt.Println("NVIDIA Power Control - Manage power limits for NVIDIA GPUs")
-	fmt.Println("\nUsage:")
-	fmt.Println("  Set power limit for all GPUs:")
-	fmt.Println("    nvidia-power-control <power_limit_in_watts>")
-	fmt.Println("\n  Set power limit for specific GPUs:")
-	fmt.Println("    nvidia-power-control --gpu=0:<power_limit> --gpu=1:<power_limit> ...")
-	fmt.Println("\n  Run in API server mode (requires config.json):")
-	fmt.Println("    nvidia-power-control")
-	fmt.Println("\nExamples:")
-	fmt.Println("  Set all GPUs to 200 watts:")
-	fmt.Println("    nvidia-power-control 200")
-	fmt.Println("\n  Set GPU 0 to 200 watts and GPU 1 to 180 watts:")
-	fmt.Println("    nvidia-power-control --gpu=0:200 --gpu=1:180")
-	fmt.Println("\nConfig.json format (for API server mode):")
-	fmt.Println(`  {
-    "mode": "all",                   // "all" or "manual"
-    "powerLimit": 250,               // Power limit in watts for "all" mode
-    "manualLimits": {                // For "manual" mode
-      "0": 220,                      // GPU index : power limit in watts
-      "1": 180
-    },
-    "apiKey": "your-secure-api-key", // Required for API server
-    "apiPort": 8080,                 // Optional, defaults to 8080
-    "startAPIServer": true           // Whether to start the API server (true/false)
-  }`)
+	for waiting := false; ; waiting = true {
+		busy := -1
+		for i := 0; i < count && busy < 0; i++ {
+			if !isGPUVisible(i) {
+				continue
+			}
+			gpuInfo, err := getGPUInfo(i)
+			if err != nil {
+				logError("GPU %d: Failed to read utilization: %v", i, err)
+				continue
+			}
+			if gpuInfo.Utilization >= threshold {
+				busy = i
+			}
+		}
+
+		if busy < 0 {
+			if waiting {
+				logInfo("GPUs are idle, applying the reloaded config")
+			}
+			return
+		}
+		if !time.Now().Before(deadline) {
+			logWarning("GPU %d is still busy after %v, applying the reloaded config anyway", busy, maxWait)
+			return
+		}
+		if !waiting {
+			logInfo("GPU %d is busy, waiting up to %v for every GPU to be below %d%% utilization before applying the reloaded config",
+				busy, maxWait, threshold)
+		}
+		time.Sleep(min(idlePollInterval, time.Until(deadline)))
+	}
 }
 
-// Initialize NVML and get GPU information
-func initNVML() error {
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		return fmt.Errorf("failed to initialize NVML: %v", nvml.ErrorString(ret))
+// Reload the config whenever its file changes
+func watchConfigFile(count int) {
+	if isRemoteConfig(configPath) {
+		logWarning("Warning: watchConfig only works with a local config file, not %s", configPath)
+		return
 	}
+	watchFile(configPath, "config", func() { reloadConfig(count) })
+}
 
-	// Get number of GPUs
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		return fmt.Errorf("failed to get device count: %v", nvml.ErrorString(ret))
+// Call onChange whenever a file changes. The directory is watched rather
+// than the file, so editors that save by replacing the file are seen.
+func watchFile(name, what string, onChange func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logError("Failed to watch %s: %v", what, err)
+		return
 	}
+	defer watcher.Close()
 
-	// Reset the GPU cache
-	gpuCache = make([]GPUInfo, count)
+	path, err := filepath.Abs(name)
+	if err != nil {
+		logError("Failed to watch %s: %v", what, err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		logError("Failed to watch %s: %v", what, err)
+		return
+	}
+	logInfo("Watching %s for changes", path)
 
-	// Populate GPU cache with information
-	for i := 0; i < count; i++ {
-		gpuInfo, err := getGPUInfo(i)
-		if err != nil {
-			log.Printf("Warning: Failed to get info for GPU %d: %v", i, err)
-			continue
+	// Act once the file has been quiet for configReloadDebounce
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) {
+				debounce = time.After(configReloadDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logError("Watch error for %s: %v", what, err)
+		case <-debounce:
+			debounce = nil
+			onChange()
 		}
-		gpuCache[i] = gpuInfo
 	}
-
-	return nil
 }
 
-// Get information for a specific GPU
-func getGPUInfo(index int) (GPUInfo, error) {
-	var info GPUInfo
-	info.Index = index
+// Split a total power budget across GPUs, evenly where their ranges allow.
+// GPUs whose range can't take an even share get their maximum or minimum and
+// the rest is shared among the others, so the total only exceeds the budget
+// when it is below the sum of the minimums.
+func distributeBudget(totalWatts uint32, gpus []GPUInfo) map[int]uint32 {
+	limits := make(map[int]uint32, len(gpus))
+	remaining := int64(totalWatts)
+	open := gpus
+	for len(open) > 0 {
+		share := remaining / int64(len(open))
 
-	// Get device handle
-	device, ret := nvml.DeviceGetHandleByIndex(index)
-	if ret != nvml.SUCCESS {
-		return info, fmt.Errorf("failed to get handle: %v", nvml.ErrorString(ret))
+		// GPUs that can't use a full share are settled first, then GPUs that need more
+		var rest []GPUInfo
+		for _, gpu := range open {
+			if int64(gpu.MaxLimit) < share {
+				limits[gpu.Index] = gpu.MaxLimit
+				remaining -= int64(gpu.MaxLimit)
+			} else {
+				rest = append(rest, gpu)
+			}
+		}
+		if len(rest) == len(open) {
+			rest = rest[:0]
+			for _, gpu := range open {
+				if int64(gpu.MinLimit) > share {
+					limits[gpu.Index] = gpu.MinLimit
+					remaining -= int64(gpu.MinLimit)
+				} else {
+					rest = append(rest, gpu)
+				}
+			}
+		}
+		if len(rest) == len(open) {
+			for _, gpu := range open {
+				limits[gpu.Index] = uint32(share)
+			}
+			break
+		}
+		open = rest
 	}
+	return limits
+}
 
-	// Get GPU name
-	name, ret := nvml.DeviceGetName(device)
-	if ret != nvml.SUCCESS {
-		name = "Unknown"
+// Budget from demandResponseFile in force, so rewrites of the same value are
+// ignored (0 = none). Guarded by budgetHoldersMutex.
+var demandResponseBudget uint32
+
+// Features currently holding the GPUs to a total budget, such as "Demand response".
+// Enforcement and config reloads leave the limits alone while any of them is
+// active, so they don't undo its throttling.
+var budgetHolders = make(map[string]bool)
+var budgetHoldersMutex sync.Mutex
+
+// Mark a budget feature as holding the GPUs' limits or letting go of them
+func setBudgetHeld(what string, held bool) {
+	budgetHoldersMutex.Lock()
+	defer budgetHoldersMutex.Unlock()
+	if held {
+		budgetHolders[what] = true
+	} else {
+		delete(budgetHolders, what)
 	}
-	info.Name = name
+}
 
-	// Check if power management is supported
-	mode, ret := nvml.DeviceGetPowerManagementMode(device)
-	if ret != nvml.SUCCESS {
-		return info, fmt.Errorf("failed to get power management mode: %v", nvml.ErrorString(ret))
+// Get the budget features holding the GPUs' limits, sorted
+func heldBudgets() []string {
+	budgetHoldersMutex.Lock()
+	defer budgetHoldersMutex.Unlock()
+	holders := make([]string, 0, len(budgetHolders))
+	for what := range budgetHolders {
+		holders = append(holders, what)
 	}
-	info.Supported = (mode == nvml.FEATURE_ENABLED)
+	sort.Strings(holders)
+	return holders
+}
 
-	if !info.Supported {
-		return info, nil // Return early with limited info if not supported
+// Read the total budget from demandResponseFile. A missing or empty file, or
+// one that says "none", means no budget (0).
+func readDemandResponseFile(path string) (uint32, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	contents := strings.TrimSpace(string(data))
+	if contents == "" || strings.EqualFold(contents, "none") {
+		return 0, nil
+	}
+	budget, err := parseWatts(contents)
+	if err != nil {
+		return 0, fmt.Errorf("ignoring %s: %v", path, err)
 	}
+	return budget, nil
+}
 
-	// Get current power limit
-	currentLimit, ret := nvml.DeviceGetPowerManagementLimit(device)
-	if ret != nvml.SUCCESS {
-		return info, fmt.Errorf("failed to get current power limit: %v", nvml.ErrorString(ret))
+// Read the total budget from demandResponseFile and spread it across the GPUs,
+// or release the limits when the file no longer sets one
+func applyDemandResponse(path string, count int) {
+	budget, err := readDemandResponseFile(path)
+	if err != nil {
+		logError("Demand response: %v", err)
+		return
 	}
-	info.PowerLimit = currentLimit / 1000 // Convert to watts
 
-	// Get power limit constraints
-	minLimit, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
-	if ret != nvml.SUCCESS {
-		return info, fmt.Errorf("failed to get power limit constraints: %v", nvml.ErrorString(ret))
+	budgetHoldersMutex.Lock()
+	current := demandResponseBudget
+	budgetHoldersMutex.Unlock()
+	if budget == current {
+		return
+	}
+	if budget == 0 {
+		setDemandResponseBudget(0)
+		logInfo("Demand response: Budget cleared, the config limits apply again")
+		return
 	}
-	info.MinLimit = minLimit / 1000 // Convert to watts
-	info.MaxLimit = maxLimit / 1000 // Convert to watts
 
-	// Get current power usage
-	power, ret := nvml.DeviceGetPowerUsage(device)
-	if ret == nvml.SUCCESS {
-		info.PowerUsage = power / 1000 // Convert to watts
+	gpus := budgetGPUs("Demand response", count)
+	if len(gpus) == 0 {
+		logWarning("Demand response: No GPUs with power management to apply %d W to", budget)
+		return
 	}
+	applyBudget("Demand response", "demand-response", budget, gpus)
+	setDemandResponseBudget(budget)
+}
 
-	return info, nil
+// Record the demand response budget in force and hold the limits while there is one
+func setDemandResponseBudget(budget uint32) {
+	budgetHoldersMutex.Lock()
+	defer budgetHoldersMutex.Unlock()
+	demandResponseBudget = budget
+	if budget > 0 {
+		budgetHolders["Demand response"] = true
+	} else {
+		delete(budgetHolders, "Demand response")
+	}
 }
 
-// Set power limit for a specific GPU
-func setPowerLimit(index int, limitWatts uint32) (GPUInfo, error) {
-	// Get device handle
-	device, ret := nvml.DeviceGetHandleByIndex(index)
-	if ret != nvml.SUCCESS {
-		return GPUInfo{}, fmt.Errorf("failed to get handle: %v", nvml.ErrorString(ret))
+// Get the visible GPUs with power management that a total budget is split across
+func budgetGPUs(what string, count int) []GPUInfo {
+	var gpus []GPUInfo
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			logError("%s: GPU %d: Failed to read power limits: %v", what, i, err)
+			continue
+		}
+		if gpuInfo.Supported {
+			gpus = append(gpus, gpuInfo)
+		}
 	}
+	return gpus
+}
 
-	// Check if power management is supported
-	mode, ret := nvml.DeviceGetPowerManagementMode(device)
-	if ret != nvml.SUCCESS {
-		return GPUInfo{}, fmt.Errorf("failed to get power management mode: %v", nvml.ErrorString(ret))
+// Split a total budget across the GPUs with distributeBudget and set the limits
+func applyBudget(what, source string, budget uint32, gpus []GPUInfo) {
+	limits := distributeBudget(budget, gpus)
+	var total uint32
+	for _, limit := range limits {
+		total += limit
 	}
-	if mode != nvml.FEATURE_ENABLED {
-		return GPUInfo{}, fmt.Errorf("power management not supported")
+	if total > budget {
+		logWarning("Warning: %s budget %d W is below the GPUs' minimum limits, using %d W", what, budget, total)
 	}
-
-	// Get power limit constraints
-	minLimit, maxLimit, ret := nvml.DeviceGetPowerManagementLimitConstraints(device)
-	if ret != nvml.SUCCESS {
-		return GPUInfo{}, fmt.Errorf("failed to get power limit constraints: %v", nvml.ErrorString(ret))
+	logInfo("%s: Distributing %d W across %d GPUs", what, budget, len(gpus))
+	for _, index := range sortedGPUIndices(limits) {
+		gpuInfo, err := setPowerLimit(index, limits[index], applyOptions{source: source})
+		if err != nil {
+			logError("%s: GPU %d: Failed to set power limit: %v", what, index, err)
+			continue
+		}
+		logInfo("%s: GPU %d (%s): Power limit %s", what, gpuInfo.Index, gpuInfo.Name, describeResult(gpuInfo))
 	}
+	if err := refreshGPUCache(); err != nil {
+		logWarning("Warning: Failed to refresh GPU cache: %v", err)
+	}
+}
 
-	// Convert watts to milliwatts
-	limitMW := limitWatts * 1000
-
-	// Clamp to allowed range
-	if limitMW < minLimit {
-		limitMW = minLimit
-		log.Printf("GPU %d: Desired limit %d W below minimum %d W, setting to %d W",
-			index, limitWatts, minLimit/1000, limitMW/1000)
-	} else if limitMW > maxLimit {
-		limitMW = maxLimit
-		log.Printf("GPU %d: Desired limit %d W above maximum %d W, setting to %d W",
-			index, limitWatts, maxLimit/1000, limitMW/1000)
+// Apply the budget in demandResponseFile now and whenever the file changes
+func watchDemandResponseFile(path string, count int) {
+	if _, err := os.Stat(path); err == nil {
+		applyDemandResponse(path, count)
 	}
+	watchFile(path, "demand response file", func() { applyDemandResponse(path, count) })
+}
 
-	// Set the new power limit
-	ret = nvml.DeviceSetPowerManagementLimit(device, limitMW)
-	if ret != nvml.SUCCESS {
-		return GPUInfo{}, fmt.Errorf("failed to set power limit: %v", nvml.ErrorString(ret))
+// Run externalMeterCmd and parse the facility power draw in watts it prints
+func readExternalMeter(command string, timeout time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run externalMeterCmd: %v", err)
+	}
+	draw, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil || draw < 0 {
+		return 0, fmt.Errorf("invalid externalMeterCmd output: %q (must be a number of watts)", strings.TrimSpace(string(output)))
 	}
+	return draw, nil
+}
 
-	// Get updated GPU info after change
-	return getGPUInfo(index)
+// Keep the facility power draw that externalMeterCmd reports under
+// externalMeterBudget by taking the excess off the GPUs. Once the draw is low
+// enough, the limits from before throttling are restored. When the command
+// fails, the current limits are kept. The meter settings are read from the
+// current config on every check, so reloads take effect.
+func runExternalMeter(count int) {
+	cfg := currentConfig()
+	interval := durationOrDefault(cfg.ExternalMeterInterval, defaultExternalMeterInterval)
+	logInfo("Checking %q every %v to keep facility power under %d W", cfg.ExternalMeterCmd, interval, cfg.ExternalMeterBudget)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var originalLimits map[int]uint32 // Limits before throttling started, nil while not throttled
+	var lastBudget float64
+	for range ticker.C {
+		cfg = currentConfig()
+		if next := durationOrDefault(cfg.ExternalMeterInterval, defaultExternalMeterInterval); next != interval {
+			logInfo("External meter: Checking every %v", next)
+			interval = next
+			ticker.Reset(interval)
+		}
+
+		// A reload that removed the meter releases any throttling
+		if cfg.ExternalMeterCmd == "" {
+			if originalLimits != nil {
+				logInfo("External meter: externalMeterCmd removed from the config, restoring the original limits")
+				restoreOriginalLimits(originalLimits, count)
+				originalLimits = nil
+				lastBudget = 0
+				setBudgetHeld("External meter", false)
+			}
+			continue
+		}
+
+		draw, err := readExternalMeter(cfg.ExternalMeterCmd, interval)
+		if err != nil {
+			logError("External meter: %v, keeping the current limits", err)
+			continue
+		}
+		excess := draw - float64(cfg.ExternalMeterBudget)
+		if excess <= 0 && originalLimits == nil {
+			continue
+		}
+
+		gpus := budgetGPUs("External meter", count)
+		if len(gpus) == 0 {
+			continue
+		}
+		var usage float64
+		for _, gpuInfo := range gpus {
+			usage += float64(gpuInfo.PowerUsage)
+		}
+		budget := max(usage-excess, 0)
+
+		if originalLimits == nil {
+			logWarning("External meter: Facility power %.0f W is over the %d W budget, throttling GPUs", draw, cfg.ExternalMeterBudget)
+			originalLimits = recordOriginalLimits(count)
+			setBudgetHeld("External meter", true)
+		} else {
+			var original float64
+			for _, limit := range originalLimits {
+				original += float64(limit)
+			}
+			if budget >= original {
+				logInfo("External meter: Facility power %.0f W leaves room for the original limits, restoring them", draw)
+				restoreOriginalLimits(originalLimits, count)
+				originalLimits = nil
+				lastBudget = 0
+				setBudgetHeld("External meter", false)
+				continue
+			}
+		}
+
+		// Small changes aren't worth a set on every GPU
+		if math.Abs(budget-lastBudget) < externalMeterDeadband {
+			continue
+		}
+		applyBudget("External meter", "external-meter", uint32(budget), gpus)
+		lastBudget = budget
+	}
 }
 
-// API middleware for authentication
-func apiKeyMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
+// Log whenever a GPU's power limit differs from the one this process last
+// applied, without correcting it. Each new value is logged once.
+func runDriftMonitor(interval time.Duration, stop <-chan os.Signal) {
+	logInfo("Monitoring power limits for drift every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		// Check if API key is valid
-		if apiKey != config.APIKey {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid API key"})
+	reported := make(map[int]uint32)
+	for {
+		select {
+		case sig := <-stop:
+			logInfo("Received %v, stopping drift monitor", sig)
 			return
+		case <-ticker.C:
 		}
 
-		// Call the next handler
-		next.ServeHTTP(w, r)
-	})
+		lastAppliedMutex.Lock()
+		applied := make(map[int]uint32, len(lastApplied))
+		for index, limit := range lastApplied {
+			applied[index] = limit
+		}
+		lastAppliedMutex.Unlock()
+
+		for index, want := range applied {
+			gpuInfo, err := getGPUInfo(index)
+			if err != nil {
+				logError("Drift: GPU %d: Failed to read power limit: %v", index, err)
+				continue
+			}
+			if gpuInfo.PowerLimit == want {
+				if _, ok := reported[index]; ok {
+					logInfo("Drift: GPU %d (%s): Power limit is back to %d W", index, gpuInfo.Name, want)
+					delete(reported, index)
+				}
+				continue
+			}
+			if last, ok := reported[index]; ok && last == gpuInfo.PowerLimit {
+				continue
+			}
+			logWarning("Drift: GPU %d (%s): Power limit changed to %d W outside this process (last applied %d W)",
+				index, gpuInfo.Name, gpuInfo.PowerLimit, want)
+			reported[index] = gpuInfo.PowerLimit
+		}
+	}
 }
 
-// API handler to get all GPU information
-func getGPUsHandler(w http.ResponseWriter, r *http.Request) {
-	// Initialize NVML to get fresh data
-	err := initNVML()
+// Print a config.json in manual mode that recreates the current power limits
+func dumpConfig(count int) error {
+	limits := make(map[int]uint32)
+	for i := 0; i < count; i++ {
+		if !isGPUVisible(i) {
+			continue
+		}
+		gpuInfo, err := getGPUInfo(i)
+		if err != nil {
+			logError("GPU %d: Failed to read power limit: %v", i, err)
+			continue
+		}
+		if !gpuInfo.Supported {
+			continue
+		}
+		limits[i] = gpuInfo.PowerLimit
+	}
+
+	dump := struct {
+		Mode           string         `json:"mode"`
+		ManualLimits   map[int]uint32 `json:"manualLimits"`
+		StartAPIServer bool           `json:"startAPIServer"`
+		APIKey         string         `json:"apiKey"`
+		APIPort        int            `json:"apiPort"`
+	}{
+		Mode:           "manual",
+		ManualLimits:   limits,
+		StartAPIServer: false,
+		APIKey:         "<api-key>",
+		APIPort:        defaultAPIPort,
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-		return
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// Print the config as loaded from the file and environment, with command line overrides and API keys redacted
+func printEffectiveConfig(flags *flag.FlagSet, opts cliOptions) error {
+	cfg, err := loadConfig()
+	if err != nil && !errors.Is(err, errNoConfigFile) {
+		return err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "strict":
+			cfg.DefaultStrict = opts.strict
+		case "dry-run":
+			cfg.DefaultDryRun = opts.dryRun
+		case "enforce-only":
+			cfg.EnforceOnly = cfg.EnforceOnly || opts.enforceOnly
+		}
+	})
+
+	if cfg.APIKey != "" {
+		cfg.APIKey = "<redacted>"
+	}
+	keys := make([]APIKeyEntry, len(cfg.APIKeys))
+	for i, entry := range cfg.APIKeys {
+		entry.Key = "<redacted>"
+		keys[i] = entry
 	}
+	cfg.APIKeys = keys
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gpuCache)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(cfg)
 }
 
-// API handler to get a specific GPU's information
-func getGPUHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	indexStr := vars["index"]
-
-	index, err := strconv.Atoi(indexStr)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid GPU index"})
-		return
+// Parse GPU specific command line parameter (--gpu=<index>:<limit>)
+func parseGPUParam(param string) (int, limitValue, error) {
+	gpuParts := strings.Split(param, ":")
+	if len(gpuParts) != 2 {
+		return -1, limitValue{}, fmt.Errorf("invalid GPU parameter: %s (expected --gpu=index:limit)", param)
 	}
 
-	// Initialize NVML to get fresh data
-	err = initNVML()
+	index, err := strconv.Atoi(gpuParts[0])
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-		return
+		return -1, limitValue{}, fmt.Errorf("invalid GPU index: %s", gpuParts[0])
 	}
 
-	if index < 0 || index >= len(gpuCache) {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "GPU index out of range"})
-		return
+	value, err := parseLimitValue(gpuParts[1])
+	if err != nil {
+		return -1, limitValue{}, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gpuCache[index])
+	return index, value, nil
 }
 
-// API handler to set power limits
-func setPowerLimitsHandler(w http.ResponseWriter, r *http.Request) {
-	var request PowerLimitRequest
-	err := json.NewDecoder(r.Body).Decode(&request)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
-		return
+// Parse a power limit given in watts ("200", "200W", "0.25kW") or as a percentage ("80%")
+func parseLimitValue(param string) (limitValue, error) {
+	if strings.HasSuffix(param, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(param, "%"), 10, 32)
+		if err != nil || percent == 0 {
+			return limitValue{}, fmt.Errorf("invalid power limit: %s (percentage must be a positive integer)", param)
+		}
+		return limitValue{percent: uint32(percent)}, nil
 	}
 
-	// Get number of GPUs
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Failed to get device count: %v", nvml.ErrorString(ret))})
-		return
+	watts, err := parseWatts(param)
+	if err != nil {
+		return limitValue{}, err
 	}
+	return limitValue{watts: watts}, nil
+}
 
-	// Process based on mode
-	var updatedGPUs []GPUInfo
-
-	if request.Mode == "all" {
-		// Set the same power limit for all GPUs
-		for i := 0; i < count; i++ {
-			updatedInfo, err := setPowerLimit(i, request.PowerLimit)
+// Parse a whole number of watts with an optional W or kW suffix (any case).
+// Kilowatts may have a decimal point, as long as they come to whole watts.
+func parseWatts(param string) (uint32, error) {
+	lower := strings.ToLower(param)
+	if number, ok := strings.CutSuffix(lower, "kw"); ok {
+		// Split the decimal by hand, floating point would turn 1.005kW into 1004.999 W
+		whole, fraction, _ := strings.Cut(number, ".")
+		fraction = strings.TrimRight(fraction, "0")
+		if whole == "" {
+			whole = "0"
+		}
+		if len(fraction) > 3 {
+			return 0, fmt.Errorf("invalid power limit: %s (must be a whole number of watts)", param)
+		}
+		kilowatts, err := strconv.ParseUint(whole, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid power limit: %s (kilowatts must be a decimal number like 0.25kW)", param)
+		}
+		watts := kilowatts * 1000
+		if fraction != "" {
+			milli, err := strconv.ParseUint(fraction+strings.Repeat("0", 3-len(fraction)), 10, 32)
 			if err != nil {
-				log.Printf("GPU %d: Failed to set power limit: %v", i, err)
-				continue
+				return 0, fmt.Errorf("invalid power limit: %s (kilowatts must be a decimal number like 0.25kW)", param)
 			}
-			updatedGPUs = append(updatedGPUs, updatedInfo)
+			watts += milli
 		}
-	} else if request.Mode == "manual" {
-		// Set specific power limits for specified GPUs
-		for gpuIndex, powerLimit := range request.ManualLimits {
-			if gpuIndex >= 0 && gpuIndex < count {
-				updatedInfo, err := setPowerLimit(gpuIndex, powerLimit)
-				if err != nil {
-					log.Printf("GPU %d: Failed to set power limit: %v", gpuIndex, err)
-					continue
-				}
-				updatedGPUs = append(updatedGPUs, updatedInfo)
-			} else {
-				log.Printf("Warning: GPU %d specified in request doesn't exist", gpuIndex)
-			}
+		if watts == 0 || watts > math.MaxUint32 {
+			return 0, fmt.Errorf("invalid power limit: %s (must be a positive whole number of watts)", param)
 		}
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid mode (must be 'all' or 'manual')"})
-		return
+		return uint32(watts), nil
 	}
 
-	// Update the GPU cache with new information
-	err = initNVML()
-	if err != nil {
-		log.Printf("Warning: Failed to refresh GPU cache: %v", err)
+	limit, err := strconv.ParseUint(strings.TrimSuffix(lower, "w"), 10, 32)
+	if err != nil || limit == 0 {
+		return 0, fmt.Errorf("invalid power limit: %s (must be a positive integer, optionally with W or kW)", param)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedGPUs)
+	return uint32(limit), nil
 }
 
-// Start the API server
-func startAPIServer() {
-	router := mux.NewRouter()
-
-	// Apply middleware to all routes
-	api := router.PathPrefix("/api").Subrouter()
-	api.Use(apiKeyMiddleware)
+// Parse a busy threshold percentage (--busy-threshold=<percent>)
+func parseBusyThreshold(param string) (uint32, error) {
+	threshold, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || threshold > 100 {
+		return 0, fmt.Errorf("invalid busy threshold: %s (must be a percentage between 0 and 100)", param)
+	}
 
-	// Define API routes
-	api.HandleFunc("/gpus", getGPUsHandler).Methods("GET")
-	api.HandleFunc("/gpus/{index}", getGPUHandler).Methods("GET")
-	api.HandleFunc("/power", setPowerLimitsHandler).Methods("POST")
+	return uint32(threshold), nil
+}
 
-	// Start server
-	port := config.APIPort
-	if port == 0 {
-		port = 8080 // Default port
-	}
+// Command line options
+type cliOptions struct {
+	gpuLimits     gpuLimitFlags
+	skip          skipOptions
+	percentOf     string
+	enforceOnly   bool
+	dumpConfig    bool
+	printConfig   bool
+	serverOnly    bool
+	apiKey        string
+	apiPort       int
+	helpJSON      bool
+	bench         bool
+	iterations    int
+	logTo         string
+	list          bool
+	configPath    string
+	restoreOnExit bool
+	watch         bool
+	logCSV        string
+	interval      time.Duration
+	allowBelowMin bool
+	yes           bool
+	testMode      bool
+	strict        bool
+	dryRun        bool
+}
 
-	log.Printf("Starting API server on port %d", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), router))
+// Power limit for one GPU from a --gpu option
+type gpuLimit struct {
+	index int
+	value limitValue
 }
 
-// Load configuration from file
-func loadConfig() (Config, error) {
-	// Set default values
-	config := Config{
-		Mode:           "all",
-		PowerLimit:     250,
-		APIPort:        8080,
-		StartAPIServer: false, // Default to not starting API server
-	}
+// Repeatable --gpu=<index>:<limit> option
+type gpuLimitFlags []gpuLimit
 
-	// Try to load config file
-	configData, err := ioutil.ReadFile("config.json")
+func (f *gpuLimitFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *gpuLimitFlags) Set(param string) error {
+	index, value, err := parseGPUParam(param)
 	if err != nil {
-		return config, fmt.Errorf("no config.json found: %v", err)
+		return err
 	}
+	*f = append(*f, gpuLimit{index: index, value: value})
+	return nil
+}
 
-	// Parse config file
-	err = json.Unmarshal(configData, &config)
-	if err != nil {
-		return config, fmt.Errorf("failed to parse config.json: %v", err)
+// Get the GPU indices given in more than one --gpu option, in order of appearance
+func (f gpuLimitFlags) duplicates() []int {
+	seen := make(map[int]int)
+	var indices []int
+	for _, gpuLimit := range f {
+		seen[gpuLimit.index]++
+		if seen[gpuLimit.index] == 2 {
+			indices = append(indices, gpuLimit.index)
+		}
 	}
+	return indices
+}
 
-	return config, nil
+// Keep only the last --gpu option for each GPU index
+func (f gpuLimitFlags) lastPerGPU() gpuLimitFlags {
+	last := make(map[int]int)
+	for i, gpuLimit := range f {
+		last[gpuLimit.index] = i
+	}
+	var limits gpuLimitFlags
+	for i, gpuLimit := range f {
+		if last[gpuLimit.index] == i {
+			limits = append(limits, gpuLimit)
+		}
+	}
+	return limits
 }
 
-// Apply power settings from config
-func applyConfigSettings(config Config, count int) {
-	if config.Mode == "all" {
-		// Apply same power limit to all GPUs
-		fmt.Printf("Setting all GPUs to %d watts\n", config.PowerLimit)
-		for i := 0; i < count; i++ {
-			gpuInfo, err := setPowerLimit(i, config.PowerLimit)
-			if err != nil {
-				fmt.Printf("GPU %d: Failed to set power limit: %v\n", i, err)
-				continue
-			}
-			fmt.Printf("GPU %d (%s): Power limit set to %d W\n",
-				gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
+// Define the command line options
+func newFlagSet(opts *cliOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("nvidia-power-control", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard) // Errors and help are printed by main
+	flags.Usage = func() {}
+
+	flags.Var(&opts.gpuLimits, "gpu", "Set the power limit of one GPU as <index>:<limit> (repeatable)")
+	flags.Func("busy-threshold", "Only apply to GPUs whose load is at least this percentage", func(value string) error {
+		threshold, err := parseBusyThreshold(value)
+		opts.skip.busyThreshold = threshold
+		return err
+	})
+	flags.BoolVar(&opts.skip.skipBusy, "skip-busy", false, "Leave GPUs with running compute processes untouched")
+	flags.Func("percent-of", "What percentage limits are relative to: max or default", func(value string) error {
+		opts.percentOf = value
+		return validatePercentOf(value)
+	})
+	flags.BoolVar(&opts.enforceOnly, "enforce-only", false, "Apply the config, then keep re-applying it without the API server")
+	flags.BoolVar(&opts.dumpConfig, "dump-config", false, "Print a config.json that recreates the current power limits")
+	flags.BoolVar(&opts.printConfig, "print-config", false, "Print the effective config after the file, environment and flags are merged")
+	flags.Func("log-to", "Where log output goes: stdout (default) or syslog", func(value string) error {
+		if value != "stdout" && value != "syslog" {
+			return fmt.Errorf("invalid --log-to: %s (must be 'stdout' or 'syslog')", value)
 		}
-	} else if config.Mode == "manual" {
-		// Apply specific power limits
-		for gpuIndex, powerLimit := range config.ManualLimits {
-			if gpuIndex >= 0 && gpuIndex < count {
-				gpuInfo, err := setPowerLimit(gpuIndex, powerLimit)
-				if err != nil {
-					fmt.Printf("GPU %d: Failed to set power limit: %v\n", gpuIndex, err)
-					continue
-				}
-				fmt.Printf("GPU %d (%s): Power limit set to %d W\n",
-					gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
-			} else {
-				fmt.Printf("Warning: GPU %d specified in config doesn't exist\n", gpuIndex)
-			}
+		opts.logTo = value
+		return nil
+	})
+	flags.BoolVar(&opts.serverOnly, "server-only", false, "Start the API server without a config file and without applying limits")
+	flags.StringVar(&opts.apiKey, "api-key", "", "API key for the server (overrides config and NVIDIA_POWER_API_KEY)")
+	flags.IntVar(&opts.apiPort, "api-port", 0, "API server port (overrides config and NVIDIA_POWER_API_PORT)")
+	flags.BoolVar(&opts.helpJSON, "help-json", false, "Print the options and config fields as JSON")
+	flags.BoolVar(&opts.bench, "bench", false, "Time reading and setting power limits on each GPU, then restore them")
+	flags.Func("iterations", "Iterations per GPU for --bench (default 20)", func(value string) error {
+		iterations, err := strconv.Atoi(value)
+		if err != nil || iterations < 1 {
+			return fmt.Errorf("invalid iterations: %s (must be a positive number)", value)
 		}
-	} else {
-		fmt.Printf("Invalid mode in config: %s (must be 'all' or 'manual')\n", config.Mode)
-	}
+		opts.iterations = iterations
+		return nil
+	})
+	flags.BoolVar(&opts.list, "list", false, "List GPUs with their power usage and limits")
+	flags.StringVar(&opts.configPath, "config", "config.json", "Path or http(s):// URL of the config file")
+	flags.BoolVar(&opts.watch, "watch", false, "Redraw the GPU list until Ctrl-C")
+	flags.StringVar(&opts.logCSV, "log-csv", "", "Append power samples of each GPU to this CSV file until Ctrl-C")
+	flags.Func("interval", "Seconds between --watch redraws (default 2) or --log-csv rows (default 5)", func(value string) error {
+		interval, err := parseInterval(value)
+		opts.interval = interval
+		return err
+	})
+	flags.BoolVar(&opts.allowBelowMin, "unsafe-allow-below-min", false, "Don't raise limits below the minimum to the minimum (lab use only)")
+	flags.BoolVar(&opts.strict, "strict", false, "Fail instead of clamping limits outside the allowed range (default from config)")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Show the limits that would be set without setting them (default from config)")
+	flags.BoolVar(&opts.testMode, "test-mode", false, "Allow test-only config such as failRate")
+	flags.BoolVar(&opts.yes, "yes", false, "Continue despite warnings such as duplicate --gpu options")
+	flags.BoolVar(&opts.restoreOnExit, "restore-on-exit", false, "Restore the startup power limits on Ctrl-C or SIGTERM")
+	return flags
 }
 
-// Parse GPU specific command line parameter (--gpu=<index>:<limit>)
-func parseGPUParam(param string) (int, uint32, error) {
-	parts := strings.Split(param, "=")
-	if len(parts) != 2 || !strings.HasPrefix(parts[0], "--gpu") {
-		return -1, 0, fmt.Errorf("invalid parameter format: %s", param)
+// Parse a --interval value given in seconds ("2", "0.5") or as a duration ("500ms")
+func parseInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval: %s (must be seconds or a duration like 500ms)", value)
+		}
+		interval = time.Duration(seconds * float64(time.Second))
 	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid interval: %s (must be positive)", value)
+	}
+	return interval, nil
+}
 
-	gpuParts := strings.Split(parts[1], ":")
-	if len(gpuParts) != 2 {
-		return -1, 0, fmt.Errorf("invalid GPU parameter: %s (expected --gpu=index:limit)", param)
+// Parse command line options, allowing them before and after the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
+}
 
-	index, err := strconv.Atoi(gpuParts[0])
+func main() {
+	// Parse command line options first so --help works without NVML
+	var opts cliOptions
+	flags := newFlagSet(&opts)
+	args, err := parseArgs(flags, os.Args[1:])
 	if err != nil {
-		return -1, 0, fmt.Errorf("invalid GPU index: %s", gpuParts[0])
+		if errors.Is(err, flag.ErrHelp) {
+			printHelp()
+			return
+		}
+		if name, unknown := strings.CutPrefix(err.Error(), "flag provided but not defined: "); unknown {
+			fmt.Printf("Unknown option: -%s\n", name)
+		} else {
+			fmt.Println(err)
+		}
+		fmt.Println("Run 'nvidia-power-control --help' for usage.")
+		os.Exit(1)
+	}
+	if opts.helpJSON {
+		if err := printHelpJSON(flags); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 1 {
+		fmt.Printf("Unexpected arguments: %s (expected a single power limit)\n", strings.Join(args[1:], " "))
+		fmt.Println("Run 'nvidia-power-control --help' for usage.")
+		os.Exit(1)
+	}
+	if opts.serverOnly && (len(args) == 1 || len(opts.gpuLimits) > 0 || opts.enforceOnly) {
+		fmt.Println("--server-only doesn't apply limits, so it can't be combined with a power limit, --gpu or --enforce-only")
+		os.Exit(1)
+	}
+	if len(args) == 1 && len(opts.gpuLimits) > 0 {
+		fmt.Println("Use either a power limit for all GPUs or --gpu options, not both")
+		os.Exit(1)
+	}
+	for _, index := range opts.gpuLimits.duplicates() {
+		if !opts.yes {
+			fmt.Printf("GPU %d is given in more than one --gpu option (use --yes to apply the last one)\n", index)
+			os.Exit(1)
+		}
+		fmt.Printf("Warning: GPU %d is given in more than one --gpu option, applying the last one\n", index)
+	}
+	opts.gpuLimits = opts.gpuLimits.lastPerGPU()
+	sort.SliceStable(opts.gpuLimits, func(i, j int) bool { return opts.gpuLimits[i].index < opts.gpuLimits[j].index })
+	configPath = opts.configPath
+	if opts.apiPort < 0 || opts.apiPort > 65535 {
+		fmt.Printf("Invalid --api-port: %d (must be between 1 and 65535)\n", opts.apiPort)
+		os.Exit(1)
+	}
+	apiKeyOverride = opts.apiKey
+	apiPortOverride = opts.apiPort
+	allowBelowMin = opts.allowBelowMin
+	if allowBelowMin {
+		fmt.Println("WARNING: --unsafe-allow-below-min is set, limits below the GPU minimum are sent to NVML unclamped")
 	}
 
-	limit, err := strconv.ParseUint(gpuParts[1], 10, 32)
-	if err != nil {
-		return -1, 0, fmt.Errorf("invalid power limit: %s", gpuParts[1])
+	if opts.logTo == "syslog" {
+		if err := logToSyslog(); err != nil {
+			fmt.Printf("Failed to connect to syslog: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	return index, uint32(limit), nil
-}
+	// The effective config can be shown without NVML
+	if opts.printConfig {
+		if err := printEffectiveConfig(flags, opts); err != nil {
+			fmt.Printf("Error in config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-func main() {
-	// Initialize NVML first
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		fmt.Printf("Failed to initialize NVML: %v\n", nvml.ErrorString(ret))
+	// Initialize NVML - this is the only place it is initialized
+	if err := initNVML(); err != nil {
+		fmt.Printf("Failed to initialize NVML: %v\n", err)
 		os.Exit(1)
 	}
 	defer nvml.Shutdown()
 
 	// Get number of GPUs
-	count, ret := nvml.DeviceGetCount()
+	count, ret := deviceCount()
 	if ret != nvml.SUCCESS {
 		fmt.Printf("Failed to get device count: %v\n", nvml.ErrorString(ret))
 		os.Exit(1)
 	}
 
+	// Restrict the GPUs this process may touch
+	visible, err := parseVisibleGPUs(os.Getenv("NVIDIA_POWER_VISIBLE"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	visibleGPUs = visible
+
+	// The site policy in config.json also caps limits given on the command line
+	if cfg, err := loadConfig(); err == nil {
+		applyRuntimeSettings(cfg)
+		defaultStrict = cfg.DefaultStrict
+		defaultDryRun = cfg.DefaultDryRun
+		if cfg.FailRate > 0 && opts.testMode {
+			failRate = cfg.FailRate
+			fmt.Printf("WARNING: Test mode, %.0f%% of power limit changes will fail on purpose\n", failRate*100)
+		} else if cfg.FailRate > 0 {
+			fmt.Println("Warning: failRate in config is ignored without --test-mode")
+		}
+	}
+
+	// Remember the limits before anything changes them
+	var originalLimits map[int]uint32
+	if opts.restoreOnExit {
+		originalLimits = recordOriginalLimits(count)
+	}
+
+	if opts.dumpConfig {
+		if err := dumpConfig(count); err != nil {
+			fmt.Printf("Failed to dump config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.watch {
+		interval := opts.interval
+		if interval == 0 {
+			interval = defaultWatchInterval
+		}
+		watchGPUList(count, interval)
+		return
+	}
+
+	if opts.logCSV != "" {
+		interval := opts.interval
+		if interval == 0 {
+			interval = defaultCSVInterval
+		}
+		if err := logPowerCSV(opts.logCSV, count, interval); err != nil {
+			fmt.Printf("Failed to log to %s: %v\n", opts.logCSV, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.list {
+		printGPUList(count)
+		return
+	}
+
+	if opts.bench {
+		iterations := opts.iterations
+		if iterations == 0 {
+			iterations = defaultBenchIterations
+		}
+		benchGPUs(count, iterations)
+		return
+	}
+
+	// --strict and --dry-run given on the command line override the config defaults
+	var strictFlag, dryRunFlag *bool
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "strict":
+			strictFlag = &opts.strict
+		case "dry-run":
+			dryRunFlag = &opts.dryRun
+		}
+	})
+	cliApply := resolveApplyOptions("cli", strictFlag, dryRunFlag)
+	defaultStrict, defaultDryRun = cliApply.strict, cliApply.dryRun
+
 	// Check command line arguments
-	if len(os.Args) > 1 {
-		// Command line mode - process arguments
-
-		// Check for GPU-specific parameters
-		if strings.HasPrefix(os.Args[1], "--gpu") {
-			// Process each --gpu parameter
-			for _, arg := range os.Args[1:] {
-				if strings.HasPrefix(arg, "--gpu") {
-					index, limit, err := parseGPUParam(arg)
-					if err != nil {
-						fmt.Println(err)
-						printHelp()
-						os.Exit(1)
-					}
-
-					if index >= 0 && index < count {
-						gpuInfo, err := setPowerLimit(index, limit)
-						if err != nil {
-							fmt.Printf("GPU %d: Failed to set power limit: %v\n", index, err)
-							continue
-						}
-						fmt.Printf("GPU %d (%s): Power limit set to %d W\n",
-							gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
-					} else {
-						fmt.Printf("Error: GPU %d doesn't exist\n", index)
-					}
+	if len(opts.gpuLimits) > 0 {
+		// Process each --gpu option
+		for _, gpuLimit := range opts.gpuLimits {
+			index, value := gpuLimit.index, gpuLimit.value
+			if index >= 0 && index < count {
+				if skippedInfo, skipped := shouldSkipGPU(index, opts.skip); skipped {
+					fmt.Printf("GPU %d (%s): Skipped, %s\n",
+						skippedInfo.Index, skippedInfo.Name, skippedInfo.SkipReason)
+					continue
 				}
-			}
-		} else {
-			// Set the same limit for all GPUs
-			desiredW, err := strconv.ParseUint(os.Args[1], 10, 32)
-			if err != nil || desiredW == 0 {
-				fmt.Printf("Invalid power limit: %s (must be a positive integer)\n", os.Args[1])
-				printHelp()
-				os.Exit(1)
-			}
-
-			fmt.Printf("Setting all GPUs to %d watts\n", desiredW)
-			for i := 0; i < count; i++ {
-				gpuInfo, err := setPowerLimit(i, uint32(desiredW))
+				gpuInfo, err := setPowerLimitValue(index, value, opts.percentOf, cliApply)
 				if err != nil {
-					fmt.Printf("GPU %d: Failed to set power limit: %v\n", i, err)
+					fmt.Printf("GPU %d: Failed to set power limit: %v\n", index, err)
 					continue
 				}
-				fmt.Printf("GPU %d (%s): Power limit set to %d W\n",
-					gpuInfo.Index, gpuInfo.Name, gpuInfo.PowerLimit)
+				fmt.Printf("GPU %d (%s): Power limit %s\n",
+					gpuInfo.Index, gpuInfo.Name, describeResult(gpuInfo))
+			} else {
+				fmt.Printf("Error: GPU %d doesn't exist\n", index)
+			}
+		}
+
+		if opts.restoreOnExit {
+			fmt.Println("Press Ctrl-C to restore the original power limits and exit")
+			waitAndRestore(originalLimits, count)
+		}
+	} else if len(args) == 1 {
+		// Set the same limit for all GPUs
+		value, err := parseLimitValue(args[0])
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("Run 'nvidia-power-control --help' for usage.")
+			os.Exit(1)
+		}
+
+		fmt.Printf("Setting all GPUs to %s\n", describeLimit(value, opts.percentOf))
+		for i := 0; i < count; i++ {
+			if !isGPUVisible(i) {
+				continue
 			}
+			if skippedInfo, skipped := shouldSkipGPU(i, opts.skip); skipped {
+				fmt.Printf("GPU %d (%s): Skipped, %s\n",
+					skippedInfo.Index, skippedInfo.Name, skippedInfo.SkipReason)
+				continue
+			}
+			gpuInfo, err := setPowerLimitValue(i, value, opts.percentOf, cliApply)
+			if err != nil {
+				fmt.Printf("GPU %d: Failed to set power limit: %v\n", i, err)
+				continue
+			}
+			fmt.Printf("GPU %d (%s): Power limit %s\n",
+				gpuInfo.Index, gpuInfo.Name, describeResult(gpuInfo))
+		}
+
+		if opts.restoreOnExit {
+			fmt.Println("Press Ctrl-C to restore the original power limits and exit")
+			waitAndRestore(originalLimits, count)
 		}
 	} else {
-		// No command line arguments - check for config.json
+		// No power limit arguments - check for config.json
 		cfg, err := loadConfig()
+		if err != nil && opts.serverOnly && errors.Is(err, errNoConfigFile) {
+			err = nil // The server runs on defaults, the environment and flags
+		}
 		if err != nil {
+			if !errors.Is(err, errNoConfigFile) {
+				// The config was found but is invalid
+				fmt.Printf("Error in config: %v\n", err)
+				os.Exit(1)
+			}
+
 			// No config.json - show help
 			fmt.Println("No command line arguments and no config.json found.")
 			fmt.Println("Either provide command line arguments or create a config.json file.")
@@ -509,27 +6449,137 @@ func main() {
 			os.Exit(1)
 		}
 
+		// Running from the environment only, as in a container - log to stdout with the rest of the output
+		if _, err := os.Stat(configPath); err != nil && !isRemoteConfig(configPath) && opts.logTo != "syslog" {
+			log.SetOutput(os.Stdout)
+			fmt.Println("No config.json found, using settings from the environment")
+		}
+
+		// Show which GPUs can be controlled before changing anything
+		printGPUSummary(count)
+		printDriverCompatibility(count)
+
+		// Server-only mode leaves every limit to API calls, including re-applying
+		if opts.serverOnly {
+			cfg.Mode = ""
+			cfg.EnforceOnly = false
+			cfg.EnforceInterval = 0
+			cfg.StartAPIServer = true
+		}
+
 		// Config exists - first apply the settings
-		fmt.Println("Applying power settings from config.json")
-		applyConfigSettings(cfg, count)
+		if opts.serverOnly {
+			fmt.Println("Server-only mode, leaving GPUs unchanged")
+		} else if cfg.Mode == "" {
+			fmt.Println("No power limits configured, leaving GPUs unchanged")
+			applyGroupLimits(cfg, count)
+		} else {
+			fmt.Println("Applying power settings from config.json")
+			if err := applyConfigSettings(cfg, count); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// Enforce-only mode stays resident without the API server
+		if opts.enforceOnly || cfg.EnforceOnly {
+			interval := time.Duration(cfg.EnforceInterval)
+			if interval <= 0 {
+				interval = defaultEnforceInterval
+			}
+
+			startStatsd(cfg)
+			setCurrentConfig(cfg) // The loop and config reloads use the global config
+			if cfg.WatchConfig {
+				go watchConfigFile(count)
+			}
+			if cfg.DemandResponseFile != "" {
+				go watchDemandResponseFile(cfg.DemandResponseFile, count)
+			}
+			if cfg.ExternalMeterCmd != "" {
+				go runExternalMeter(count)
+			}
+
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+			runEnforcementLoop(count, interval, stop)
+			if opts.restoreOnExit {
+				restoreOriginalLimits(originalLimits, count)
+			}
+			return
+		}
 
 		// Check if we should start the API server
 		if cfg.StartAPIServer {
-			if cfg.APIKey == "" {
+			if cfg.APIKey == "" && len(cfg.APIKeys) == 0 {
 				fmt.Println("Error: API key is required to start API server")
-				fmt.Println("Please add 'apiKey' field to your config.json or set 'startAPIServer' to false")
+				fmt.Println("Please add 'apiKey' field to your config.json, set NVIDIA_POWER_API_KEY or --api-key, or set 'startAPIServer' to false")
+				os.Exit(1)
+			}
+			if err := initAPIKeys(cfg); err != nil {
+				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
 
 			// API server mode
-			config = cfg // Set global config
-			err = initNVML()
+			setCurrentConfig(cfg) // Set global config
+			err = refreshGPUCache()
 			if err != nil {
-				log.Fatalf("Failed to initialize NVML cache: %v", err)
+				logFatal("Failed to build GPU cache: %v", err)
+			}
+
+			// Watch for GPU health events in the background
+			if cfg.MonitorEvents {
+				go monitorEvents(count)
+			}
+			startStatsd(cfg)
+
+			// Log limits changed by other processes alongside the API server
+			if cfg.MonitorDrift {
+				go runDriftMonitor(durationOrDefault(cfg.DriftInterval, defaultEnforceInterval), nil)
+			}
+
+			// Keep re-applying the config limits alongside the API server
+			if cfg.EnforceInterval > 0 {
+				go runEnforcementLoop(count, time.Duration(cfg.EnforceInterval), nil)
+			}
+
+			// Reload and re-apply the config when its file changes
+			if cfg.WatchConfig {
+				go watchConfigFile(count)
+			}
+
+			// Cap the GPUs to the total a facility controller writes to a file
+			if cfg.DemandResponseFile != "" {
+				go watchDemandResponseFile(cfg.DemandResponseFile, count)
+			}
+
+			// Throttle the GPUs while a facility power meter reads over budget
+			if cfg.ExternalMeterCmd != "" {
+				go runExternalMeter(count)
+			}
+
+			// The server never returns, so restore and shut down from a signal handler
+			if opts.restoreOnExit {
+				go func() {
+					waitAndRestore(originalLimits, count)
+					nvml.Shutdown()
+					os.Exit(0)
+				}()
 			}
 
 			fmt.Println("Starting API server mode")
 			startAPIServer()
+		} else if cfg.MonitorDrift {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+			runDriftMonitor(durationOrDefault(cfg.DriftInterval, defaultEnforceInterval), stop)
+			if opts.restoreOnExit {
+				restoreOriginalLimits(originalLimits, count)
+			}
+		} else if opts.restoreOnExit {
+			fmt.Println("Applied settings from config.json, press Ctrl-C to restore the original power limits and exit")
+			waitAndRestore(originalLimits, count)
 		} else {
 			fmt.Println("Applied settings from config.json, exiting")
 		}
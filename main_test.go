@@ -0,0 +1,821 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Serve the stream from a primed cache so the handler never touches NVML
+func primeGPUCache(t *testing.T) {
+	t.Helper()
+
+	savedConfig := config
+	gpuCacheMutex.Lock()
+	savedCache, savedUpdated := gpuCache, gpuCacheUpdated
+	gpuCache = []GPUInfo{{Index: 0, Name: "Test GPU"}}
+	gpuCacheUpdated = time.Now()
+	gpuCacheMutex.Unlock()
+
+	config.CacheTTL = Duration(time.Hour)
+	config.StreamInterval = Duration(10 * time.Millisecond)
+
+	t.Cleanup(func() {
+		config = savedConfig
+		gpuCacheMutex.Lock()
+		gpuCache, gpuCacheUpdated = savedCache, savedUpdated
+		gpuCacheMutex.Unlock()
+	})
+}
+
+// Wait for the goroutine count to drop back to at most want
+func waitForGoroutines(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d running, want at most %d", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamGPUsHandlerClientDisconnect(t *testing.T) {
+	primeGPUCache(t)
+
+	returned := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(returned)
+		streamGPUsHandler(w, r)
+	}))
+	defer server.Close()
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read one event, then drop the connection mid-stream
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading first event: %v", err)
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("first line = %q, want a data event", line)
+	}
+	cancel()
+	response.Body.Close()
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+	http.DefaultClient.CloseIdleConnections()
+	waitForGoroutines(t, before)
+}
+
+func TestStreamGPUsHandlerCanceledContext(t *testing.T) {
+	primeGPUCache(t)
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := httptest.NewRequest(http.MethodGet, "/api/stream", nil).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		streamGPUsHandler(recorder, request)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return for a canceled request")
+	}
+	if body := recorder.Body.String(); strings.Count(body, "data: ") > 1 {
+		t.Errorf("handler kept writing after the request was canceled: %q", body)
+	}
+	waitForGoroutines(t, before)
+}
+
+func TestLoadConfigAPIPort(t *testing.T) {
+	tests := []struct {
+		port    int
+		want    int
+		wantErr string
+	}{
+		{port: 0, want: defaultAPIPort},
+		{port: 9090, want: 9090},
+		{port: 65535, want: 65535},
+		{port: -1, wantErr: "invalid apiPort: -1 (must be between 1 and 65535, or 0 for the default 8080)"},
+		{port: 65536, wantErr: "invalid apiPort: 65536 (must be between 1 and 65535, or 0 for the default 8080)"},
+	}
+
+	savedPath := configPath
+	defer func() { configPath = savedPath }()
+	t.Setenv("NVIDIA_POWER_API_PORT", "")
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.port), func(t *testing.T) {
+			configPath = filepath.Join(t.TempDir(), "config.json")
+			data := fmt.Sprintf(`{"mode": "all", "powerLimit": 250, "apiPort": %d}`, test.port)
+			if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig()
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("loadConfig() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if cfg.APIPort != test.want {
+				t.Errorf("APIPort = %d, want %d", cfg.APIPort, test.want)
+			}
+		})
+	}
+}
+
+func TestInitAPIKeysKeepsRuntimeKeys(t *testing.T) {
+	apiKeysMutex.Lock()
+	savedKeys, savedLabels := apiKeys, configAPIKeyLabels
+	apiKeys, configAPIKeyLabels = nil, nil
+	apiKeysMutex.Unlock()
+	defer func() {
+		apiKeysMutex.Lock()
+		apiKeys, configAPIKeyLabels = savedKeys, savedLabels
+		apiKeysMutex.Unlock()
+	}()
+
+	cfg := Config{APIKeys: []APIKeyEntry{{Label: "ops", Key: "ops-key", Admin: true}, {Label: "old", Key: "old-key"}}}
+	if err := initAPIKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	apiKeysMutex.Lock()
+	apiKeys = append(apiKeys, APIKeyEntry{Label: "ci", Key: "ci-key"}, APIKeyEntry{Label: "new", Key: "runtime-key"})
+	apiKeysMutex.Unlock()
+
+	// The reloaded config drops "old" and now defines "new" itself
+	cfg.APIKeys = []APIKeyEntry{{Label: "ops", Key: "ops-key", Admin: true}, {Label: "new", Key: "config-key"}}
+	if err := initAPIKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"ops": "ops-key", "new": "config-key", "ci": "ci-key"}
+	got := make(map[string]string)
+	apiKeysMutex.RLock()
+	for _, entry := range apiKeys {
+		got[entry.Label] = entry.Key
+	}
+	apiKeysMutex.RUnlock()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("API keys after reload = %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigFlagOverrides(t *testing.T) {
+	savedPath := configPath
+	defer func() { configPath, apiKeyOverride, apiPortOverride = savedPath, "", 0 }()
+	t.Setenv("NVIDIA_POWER_API_KEY", "env-key")
+	t.Setenv("NVIDIA_POWER_API_PORT", "9000")
+
+	configPath = filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"mode": "all", "powerLimit": 250, "apiKey": "file-key", "apiPort": 8081}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiKeyOverride, apiPortOverride = "flag-key", 9090
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.APIKey != "flag-key" || cfg.APIPort != 9090 {
+		t.Errorf("APIKey, APIPort = %q, %d, want %q, %d", cfg.APIKey, cfg.APIPort, "flag-key", 9090)
+	}
+}
+
+func TestWriteRuntimeMetrics(t *testing.T) {
+	var out strings.Builder
+	writeRuntimeMetrics(&out)
+	for _, name := range []string{"go_goroutines ", "go_memstats_alloc_bytes ", "go_gc_duration_seconds{", "process_start_time_seconds "} {
+		if !strings.Contains(out.String(), "\n"+name) {
+			t.Errorf("runtime metrics are missing %s", strings.TrimRight(name, " {"))
+		}
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrPowerMgmtUnsupported, http.StatusUnprocessableEntity},
+		{fmt.Errorf("fan control %w", ErrNotSupported), http.StatusUnprocessableEntity},
+		{fmt.Errorf("%w: GPU index 9 (found 2 GPUs)", ErrOutOfRange), http.StatusBadRequest},
+		{fmt.Errorf("%w: GPU 1", ErrNotVisible), http.StatusForbidden},
+		{&cooldownError{index: 0, cooldown: time.Second, retryIn: time.Second}, http.StatusTooManyRequests},
+		{fmt.Errorf("something else"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := statusForError(test.err); got != test.want {
+			t.Errorf("statusForError(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestReadDemandResponseFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents *string
+		want     uint32
+		wantErr  bool
+	}{
+		{name: "missing"},
+		{name: "empty", contents: ptr("")},
+		{name: "none", contents: ptr("none\n")},
+		{name: "noneUpper", contents: ptr("NONE")},
+		{name: "watts", contents: ptr("1500\n"), want: 1500},
+		{name: "kilowatts", contents: ptr("1.5kW"), want: 1500},
+		{name: "invalid", contents: ptr("lots"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if test.contents != nil {
+				if err := os.WriteFile(path, []byte(*test.contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := readDemandResponseFile(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readDemandResponseFile() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("readDemandResponseFile() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDemandResponseHoldRelease(t *testing.T) {
+	defer setDemandResponseBudget(0)
+	path := filepath.Join(t.TempDir(), "budget")
+
+	// A budget in force holds the limits
+	setDemandResponseBudget(1500)
+	if holders := heldBudgets(); fmt.Sprint(holders) != "[Demand response]" {
+		t.Fatalf("heldBudgets() = %v, want [Demand response]", holders)
+	}
+
+	// Each way of clearing the file releases them, and the same budget can be applied again
+	for _, clear := range []func() error{
+		func() error { return os.WriteFile(path, []byte("none"), 0644) },
+		func() error { return os.WriteFile(path, nil, 0644) },
+		func() error { return os.Remove(path) },
+	} {
+		setDemandResponseBudget(1500)
+		if err := clear(); err != nil {
+			t.Fatal(err)
+		}
+		applyDemandResponse(path, 0)
+		if holders := heldBudgets(); len(holders) != 0 {
+			t.Errorf("heldBudgets() after clearing = %v, want none", holders)
+		}
+		budgetHoldersMutex.Lock()
+		budget := demandResponseBudget
+		budgetHoldersMutex.Unlock()
+		if budget != 0 {
+			t.Errorf("demandResponseBudget after clearing = %d, want 0", budget)
+		}
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+// Capture log output for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+func TestReloadConfigLeavesHeldLimits(t *testing.T) {
+	savedPath, savedConfig := configPath, currentConfig()
+	defer func() {
+		configPath = savedPath
+		setCurrentConfig(savedConfig)
+	}()
+	defer setBudgetHeld("External meter", false)
+
+	configPath = filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"mode": "all", "powerLimit": 200, "externalMeterBudget": 5000}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := captureLog(t)
+
+	setBudgetHeld("External meter", true)
+	reloadConfig(1)
+
+	if !strings.Contains(out.String(), "limits left alone while External meter holds them") {
+		t.Errorf("reload log = %q, want the limits left alone", out.String())
+	}
+	if cfg := currentConfig(); cfg.PowerLimit != 200 || cfg.ExternalMeterBudget != 5000 {
+		t.Errorf("reloaded config powerLimit, externalMeterBudget = %d, %d, want 200, 5000", cfg.PowerLimit, cfg.ExternalMeterBudget)
+	}
+}
+
+// Fake NVML list query that reports the clocks in lists, one list per call so
+// the list can change between the probe and the read
+func fakeClockQuery(lists ...[]uint32) (func(count, clocks *uint32) nvml.Return, *int) {
+	calls := 0
+	return func(count, clocks *uint32) nvml.Return {
+		list := lists[min(calls, len(lists)-1)]
+		calls++
+		if int(*count) < len(list) {
+			*count = uint32(len(list))
+			return nvml.ERROR_INSUFFICIENT_SIZE
+		}
+		copy(unsafe.Slice(clocks, *count), list)
+		*count = uint32(len(list))
+		return nvml.SUCCESS
+	}, &calls
+}
+
+func TestReadClockList(t *testing.T) {
+	tests := []struct {
+		name      string
+		lists     [][]uint32
+		want      []uint32
+		wantRet   nvml.Return
+		wantCalls int
+	}{
+		{name: "empty", lists: [][]uint32{{}}, want: []uint32{}, wantRet: nvml.SUCCESS, wantCalls: 1},
+		{name: "single", lists: [][]uint32{{1215}}, want: []uint32{1215}, wantRet: nvml.SUCCESS, wantCalls: 1},
+		{name: "probeThenRead", lists: [][]uint32{{1215, 810, 405}}, want: []uint32{1215, 810, 405}, wantRet: nvml.SUCCESS, wantCalls: 2},
+		{name: "grewAfterProbe", lists: [][]uint32{{1215, 810}, {1215, 810, 405, 300}}, want: []uint32{1215, 810, 405, 300}, wantRet: nvml.SUCCESS, wantCalls: 3},
+		{name: "keepsGrowing", lists: [][]uint32{{1, 2}, {1, 2, 3, 4, 5}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}, wantRet: nvml.ERROR_INSUFFICIENT_SIZE, wantCalls: clockListAttempts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, calls := fakeClockQuery(test.lists...)
+			got, ret := readClockList(query)
+			if ret != test.wantRet {
+				t.Fatalf("readClockList() return = %v, want %v", ret, test.wantRet)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("readClockList() = %v, want %v", got, test.want)
+			}
+			if *calls != test.wantCalls {
+				t.Errorf("readClockList() made %d calls, want %d", *calls, test.wantCalls)
+			}
+		})
+	}
+
+	// Errors other than the size are returned as they are
+	got, ret := readClockList(func(count, clocks *uint32) nvml.Return { return nvml.ERROR_NOT_SUPPORTED })
+	if got != nil || ret != nvml.ERROR_NOT_SUPPORTED {
+		t.Errorf("readClockList() = %v, %v, want nil, ERROR_NOT_SUPPORTED", got, ret)
+	}
+}
+
+func TestSimulatedFailure(t *testing.T) {
+	defer func(saved float64) { failRate = saved }(failRate)
+
+	tests := []struct {
+		rate     float64
+		wantFail bool
+	}{
+		{rate: 0, wantFail: false},
+		{rate: 1, wantFail: true},
+	}
+	for _, test := range tests {
+		failRate = test.rate
+		for i := 0; i < 100; i++ {
+			err := simulatedFailure()
+			if (err != nil) != test.wantFail {
+				t.Fatalf("failRate %v: simulatedFailure() = %v, want failure %v", test.rate, err, test.wantFail)
+			}
+			if err != nil && !errors.Is(err, ErrNVML) {
+				t.Fatalf("failRate %v: simulatedFailure() = %v, want ErrNVML", test.rate, err)
+			}
+		}
+	}
+}
+
+func TestMarshalGPUJSON(t *testing.T) {
+	defer func(saved string) { jsonCase = saved }(jsonCase)
+
+	gpus := []GPUInfo{{
+		Index:         1,
+		MemoryTotalMB: 24576,
+		Supported:     true,
+		Labels:        map[string]string{"rackUnit": "4"},
+		NvlinkLinks:   []NvlinkStatus{{Link: 0, TxKiB: 10, RxKiB: 20}},
+	}}
+	tests := []struct {
+		jsonCase    string
+		want        []string
+		wantMissing []string
+	}{
+		{
+			jsonCase:    "camel",
+			want:        []string{`"memoryTotalMB":24576`, `"powerManagement":true`, `"nvlinkLinks":[{"link":0,"txKiB":10,"rxKiB":20}]`, `"labels":{"rackUnit":"4"}`},
+			wantMissing: []string{`"serial"`, `_`},
+		},
+		{
+			jsonCase:    "snake",
+			want:        []string{`"memory_total_mb":24576`, `"power_management_supported":true`, `"nvlink_links":[{"link":0,"tx_kib":10,"rx_kib":20}]`, `"labels":{"rackUnit":"4"}`},
+			wantMissing: []string{`"serial"`, `"memoryTotalMB"`, `"txKiB"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.jsonCase, func(t *testing.T) {
+			jsonCase = test.jsonCase
+			var buffer bytes.Buffer
+			if err := writeGPUJSON(&buffer, gpus); err != nil {
+				t.Fatalf("writeGPUJSON() error = %v", err)
+			}
+			got := buffer.String()
+			for _, want := range test.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("writeGPUJSON() = %s, want it to contain %s", got, want)
+				}
+			}
+			for _, missing := range test.wantMissing {
+				if strings.Contains(got, missing) {
+					t.Errorf("writeGPUJSON() = %s, want no %s", got, missing)
+				}
+			}
+		})
+	}
+
+	// Both casings carry the same fields in the same order
+	jsonCase = "camel"
+	camel, _ := marshalGPUJSON(gpus[0])
+	jsonCase = "snake"
+	snake, _ := marshalGPUJSON(gpus[0])
+	var camelKeys, snakeKeys []string
+	for _, pair := range []struct {
+		data []byte
+		keys *[]string
+	}{{camel, &camelKeys}, {snake, &snakeKeys}} {
+		decoder := json.NewDecoder(bytes.NewReader(pair.data))
+		decoder.Token()
+		for decoder.More() {
+			key, _ := decoder.Token()
+			*pair.keys = append(*pair.keys, key.(string))
+			var value json.RawMessage
+			decoder.Decode(&value)
+		}
+	}
+	if len(camelKeys) != len(snakeKeys) {
+		t.Fatalf("camel keys %v and snake keys %v differ in number", camelKeys, snakeKeys)
+	}
+	for i, key := range camelKeys {
+		want, ok := snakeCaseNames[key]
+		if !ok {
+			want = snakeCase(key)
+		}
+		if snakeKeys[i] != want {
+			t.Errorf("snake key %d = %s, want %s", i, snakeKeys[i], want)
+		}
+	}
+}
+
+func TestGetAuditHandlerPaging(t *testing.T) {
+	changeLogMutex.Lock()
+	savedLog, savedSeq := auditLog, auditSeq
+	// Changes applied together share a timestamp
+	now := time.Now()
+	auditLog, auditSeq = nil, 0
+	for i := 0; i < 5; i++ {
+		auditSeq++
+		auditLog = append(auditLog, AuditEntry{Seq: auditSeq, Timestamp: now, Index: i, OldLimit: 300, NewLimit: 250, Source: "api"})
+	}
+	changeLogMutex.Unlock()
+	defer func() {
+		changeLogMutex.Lock()
+		auditLog, auditSeq = savedLog, savedSeq
+		changeLogMutex.Unlock()
+	}()
+
+	get := func(query string) (int, []AuditEntry) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		getAuditHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/audit?"+query, nil))
+		var entries []AuditEntry
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&entries); err != nil {
+				t.Fatalf("GET /api/audit?%s: decoding response: %v", query, err)
+			}
+		}
+		return recorder.Code, entries
+	}
+
+	// Paging by seq sees every entry once
+	var indices []int
+	var after uint64
+	for page := 0; page < 5; page++ {
+		status, entries := get(fmt.Sprintf("after=%d&limit=2", after))
+		if status != http.StatusOK {
+			t.Fatalf("GET /api/audit?after=%d: status %d", after, status)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			indices = append(indices, entry.Index)
+		}
+		after = entries[len(entries)-1].Seq
+	}
+	if fmt.Sprint(indices) != "[0 1 2 3 4]" {
+		t.Errorf("paged audit entries for GPUs %v, want [0 1 2 3 4]", indices)
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{query: "", wantStatus: http.StatusOK, wantCount: 5},
+		{query: "after=3", wantStatus: http.StatusOK, wantCount: 2},
+		{query: "after=5", wantStatus: http.StatusOK, wantCount: 0},
+		{query: "since=" + now.Add(-time.Second).Format(time.RFC3339Nano), wantStatus: http.StatusOK, wantCount: 5},
+		{query: "since=" + now.Format(time.RFC3339Nano), wantStatus: http.StatusOK, wantCount: 0},
+		{query: "after=-1", wantStatus: http.StatusBadRequest},
+		{query: "after=x", wantStatus: http.StatusBadRequest},
+		{query: "limit=0", wantStatus: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		status, entries := get(test.query)
+		if status != test.wantStatus || len(entries) != test.wantCount {
+			t.Errorf("GET /api/audit?%s = %d with %d entries, want %d with %d", test.query, status, len(entries), test.wantStatus, test.wantCount)
+		}
+	}
+}
+
+func TestGetJobHandlerScopedKeys(t *testing.T) {
+	apiKeysMutex.Lock()
+	savedKeys := apiKeys
+	apiKeys = []APIKeyEntry{
+		{Label: "default", Key: "admin-key", Admin: true},
+		{Label: "scheduler", Key: "scheduler-key", AllowedPaths: []string{"/api/power"}},
+		{Label: "batch", Key: "batch-key", AllowedPaths: []string{"/api/power"}},
+		{Label: "jobs", Key: "jobs-key", AllowedPaths: []string{"/api/jobs"}},
+	}
+	apiKeysMutex.Unlock()
+	jobsMutex.Lock()
+	jobs["scheduler-job"] = &Job{ID: "scheduler-job", Status: "running", Created: time.Now(), owner: "scheduler"}
+	jobsMutex.Unlock()
+	defer func() {
+		apiKeysMutex.Lock()
+		apiKeys = savedKeys
+		apiKeysMutex.Unlock()
+		jobsMutex.Lock()
+		delete(jobs, "scheduler-job")
+		jobsMutex.Unlock()
+	}()
+
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/jobs/{id}", getJobHandler)
+	api.HandleFunc("GET /api/gpus", func(w http.ResponseWriter, r *http.Request) {})
+	handler := apiKeyMiddleware(api)
+
+	tests := []struct {
+		key        string
+		path       string
+		wantStatus int
+	}{
+		{key: "scheduler-key", path: "/api/jobs/scheduler-job", wantStatus: http.StatusOK},
+		{key: "batch-key", path: "/api/jobs/scheduler-job", wantStatus: http.StatusNotFound},
+		{key: "jobs-key", path: "/api/jobs/scheduler-job", wantStatus: http.StatusOK},
+		{key: "admin-key", path: "/api/jobs/scheduler-job", wantStatus: http.StatusOK},
+		{key: "scheduler-key", path: "/api/jobs/unknown", wantStatus: http.StatusNotFound},
+		{key: "scheduler-key", path: "/api/gpus", wantStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		request.Header.Set("X-API-Key", test.key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.wantStatus {
+			t.Errorf("GET %s with %s = %d, want %d", test.path, test.key, recorder.Code, test.wantStatus)
+		}
+	}
+}
+
+func TestSetGroupPowerHandlerRejectsUnsupported(t *testing.T) {
+	savedConfig := currentConfig()
+	defer setCurrentConfig(savedConfig)
+	cfg := savedConfig
+	cfg.Groups = map[string]GPUGroup{"training": {Indices: []int{1, 0}, PowerLimit: 250}}
+	setCurrentConfig(cfg)
+
+	tests := []struct {
+		name       string
+		group      string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "unknownGroup", group: "inference", body: `{}`, wantStatus: http.StatusNotFound, wantError: "Group inference not found"},
+		{name: "atomic", group: "training", body: `{"atomic": true}`, wantStatus: http.StatusBadRequest, wantError: "Unsupported field for group requests: atomic"},
+		{name: "async", group: "training", body: `{"async": true}`, wantStatus: http.StatusBadRequest, wantError: "Unsupported field for group requests: async"},
+		{name: "malformed", group: "training", body: `{"powerLimit": "high"}`, wantStatus: http.StatusBadRequest, wantError: "Invalid request format"},
+		{name: "badRamp", group: "training", body: `{"ramp": {"steps": 0, "durationMs": 1000}}`, wantStatus: http.StatusBadRequest, wantError: "invalid ramp steps"},
+		{name: "badClampPolicy", group: "training", body: `{"clampPolicy": "maybe"}`, wantStatus: http.StatusBadRequest, wantError: "clampPolicy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/groups/"+test.group+"/power", strings.NewReader(test.body))
+			request.SetPathValue("name", test.group)
+			recorder := httptest.NewRecorder()
+			setGroupPowerHandler(recorder, request)
+			if recorder.Code != test.wantStatus || !strings.Contains(recorder.Body.String(), test.wantError) {
+				t.Errorf("POST %s = %d %s, want %d with %q", request.URL.Path, recorder.Code, recorder.Body.String(), test.wantStatus, test.wantError)
+			}
+		})
+	}
+}
+
+func TestLogSeverity(t *testing.T) {
+	type message struct {
+		severity logSeverity
+		text     string
+	}
+	var got []message
+	severityLog = func(severity logSeverity, text string) { got = append(got, message{severity, text}) }
+	defer func() { severityLog = nil }()
+
+	// The severity comes from the call, not from the words in the message
+	logInfo("GPU %d: Failed over to the backup meter", 0)
+	logWarning("GPU %d: Desired limit %d W above maximum", 1, 400)
+	logError("Config reload failed: %v", os.ErrNotExist)
+	want := []message{
+		{severityInfo, "GPU 0: Failed over to the backup meter"},
+		{severityWarning, "GPU 1: Desired limit 400 W above maximum"},
+		{severityError, "Config reload failed: file does not exist"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("logged %v, want %v", got, want)
+	}
+
+	// Without a severity output, messages go to the standard logger
+	severityLog = nil
+	out := captureLog(t)
+	logWarning("Warning: %s", "on stderr")
+	if !strings.Contains(out.String(), "Warning: on stderr") {
+		t.Errorf("standard log = %q, want the warning", out.String())
+	}
+}
+
+func TestEnvelopeMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		body       string
+		wantStatus int
+		wantBody   string
+		wantFields []string
+	}{
+		{name: "data", path: "/api/gpus", status: http.StatusOK, body: `[{"index":0}]` + "\n", wantStatus: http.StatusOK, wantFields: []string{"data", "meta"}},
+		{name: "error", path: "/api/power", status: http.StatusBadRequest, body: `{"error":"Invalid mode"}`, wantStatus: http.StatusBadRequest, wantFields: []string{"error", "meta"}},
+		{name: "errorNotObject", path: "/api/power", status: http.StatusInternalServerError, body: `"failed"`, wantStatus: http.StatusInternalServerError, wantFields: []string{"error", "meta"}},
+		{name: "empty", path: "/api/keys/ops", status: http.StatusNoContent, body: "", wantStatus: http.StatusNoContent, wantBody: ""},
+		{name: "notJSON", path: "/api/metrics", status: http.StatusOK, body: "gpu_power 1\n", wantStatus: http.StatusOK, wantBody: "gpu_power 1\n"},
+		{name: "stream", path: "/api/stream", status: http.StatusOK, body: "data: []\n\n", wantStatus: http.StatusOK, wantBody: "data: []\n\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := envelopeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			requestID := recorder.Header().Get("X-Request-ID")
+			if len(requestID) != 36 || requestID[14] != '4' {
+				t.Errorf("X-Request-ID = %q, want a version 4 UUID", requestID)
+			}
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if test.wantFields == nil {
+				if recorder.Body.String() != test.wantBody {
+					t.Errorf("body = %q, want %q unchanged", recorder.Body.String(), test.wantBody)
+				}
+				return
+			}
+
+			var envelope map[string]json.RawMessage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("body %q is not a JSON object: %v", recorder.Body.String(), err)
+			}
+			for _, field := range test.wantFields {
+				if _, ok := envelope[field]; !ok {
+					t.Errorf("envelope %s has no %s", recorder.Body.String(), field)
+				}
+			}
+			var meta ResponseMeta
+			if err := json.Unmarshal(envelope["meta"], &meta); err != nil || meta.RequestID != requestID || meta.Timestamp.IsZero() {
+				t.Errorf("meta = %s, want the request ID %s and a timestamp", envelope["meta"], requestID)
+			}
+		})
+	}
+}
+
+func TestDistributeBudget(t *testing.T) {
+	gpu := func(index int, minLimit, maxLimit uint32) GPUInfo {
+		return GPUInfo{Index: index, MinLimit: minLimit, MaxLimit: maxLimit}
+	}
+	tests := []struct {
+		name   string
+		budget uint32
+		gpus   []GPUInfo
+		want   map[int]uint32
+	}{
+		{name: "evenSplit", budget: 600, gpus: []GPUInfo{gpu(0, 100, 350), gpu(1, 100, 350)}, want: map[int]uint32{0: 300, 1: 300}},
+		{name: "smallMaxGivesBack", budget: 600, gpus: []GPUInfo{gpu(0, 100, 200), gpu(1, 100, 450)}, want: map[int]uint32{0: 200, 1: 400}},
+		{name: "largeMinTakesFirst", budget: 400, gpus: []GPUInfo{gpu(0, 250, 350), gpu(1, 100, 350)}, want: map[int]uint32{0: 250, 1: 150}},
+		{name: "aboveEveryMax", budget: 1000, gpus: []GPUInfo{gpu(0, 100, 300), gpu(1, 100, 300)}, want: map[int]uint32{0: 300, 1: 300}},
+		{name: "none", budget: 500, gpus: nil, want: map[int]uint32{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := distributeBudget(test.budget, test.gpus); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("distributeBudget(%d) = %v, want %v", test.budget, got, test.want)
+			}
+		})
+	}
+}
+
+func TestClaimSetSlot(t *testing.T) {
+	configMutex.Lock()
+	savedCooldown := setCooldown
+	setCooldown = time.Minute
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		setCooldown = savedCooldown
+		configMutex.Unlock()
+		lastSetTimesMutex.Lock()
+		delete(lastSetTimes, 90)
+		delete(lastSetTimes, 91)
+		lastSetTimesMutex.Unlock()
+	}()
+
+	tests := []struct {
+		index        int
+		wantCooldown bool
+	}{
+		{index: 90, wantCooldown: false},
+		{index: 90, wantCooldown: true},
+		{index: 91, wantCooldown: false},
+	}
+	for _, test := range tests {
+		err := claimSetSlot(test.index)
+		var cooldown *cooldownError
+		if errors.As(err, &cooldown) != test.wantCooldown {
+			t.Fatalf("claimSetSlot(%d) = %v, want cooldown %v", test.index, err, test.wantCooldown)
+		}
+		if cooldown != nil && (statusForError(err) != http.StatusTooManyRequests || cooldown.retryIn <= 0) {
+			t.Errorf("claimSetSlot(%d) = %v with status %d, want 429 and a retry time", test.index, err, statusForError(err))
+		}
+	}
+}
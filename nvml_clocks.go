@@ -0,0 +1,86 @@
+package main
+
+/*
+#cgo linux LDFLAGS: -Wl,--export-dynamic -Wl,--unresolved-symbols=ignore-in-object-files
+#cgo darwin LDFLAGS: -Wl,-undefined,dynamic_lookup
+
+// The NVML library is loaded by nvml.Init with RTLD_GLOBAL, which resolves these
+// at run time like go-nvml's own bindings
+typedef struct nvmlDevice_st *nvmlDevice_t;
+typedef int nvmlReturn_t;
+
+nvmlReturn_t nvmlDeviceGetSupportedMemoryClocks(nvmlDevice_t device, unsigned int *count, unsigned int *clocksMHz);
+nvmlReturn_t nvmlDeviceGetSupportedGraphicsClocks(nvmlDevice_t device, unsigned int memoryClockMHz, unsigned int *count, unsigned int *clocksMHz);
+*/
+import "C"
+
+import (
+	"reflect"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// The go-nvml wrappers of nvmlDeviceGetSupportedMemoryClocks and
+// nvmlDeviceGetSupportedGraphicsClocks pass a single-element buffer, so they
+// only report how many clocks there are. These call NVML with a full buffer.
+
+// Get the memory clocks a GPU supports, in MHz
+func supportedMemoryClocks(device nvml.Device) ([]uint32, nvml.Return) {
+	handle, ok := cDeviceHandle(device)
+	if !ok {
+		return nil, nvml.ERROR_INVALID_ARGUMENT
+	}
+	return readClockList(func(count, clocks *uint32) nvml.Return {
+		return nvml.Return(C.nvmlDeviceGetSupportedMemoryClocks(handle, (*C.uint)(count), (*C.uint)(clocks)))
+	})
+}
+
+// Get the graphics clocks a GPU supports at a memory clock, in MHz
+func supportedGraphicsClocks(device nvml.Device, memoryClock uint32) ([]uint32, nvml.Return) {
+	handle, ok := cDeviceHandle(device)
+	if !ok {
+		return nil, nvml.ERROR_INVALID_ARGUMENT
+	}
+	return readClockList(func(count, clocks *uint32) nvml.Return {
+		return nvml.Return(C.nvmlDeviceGetSupportedGraphicsClocks(handle, C.uint(memoryClock), (*C.uint)(count), (*C.uint)(clocks)))
+	})
+}
+
+// Get the NVML handle inside a go-nvml device
+func cDeviceHandle(device nvml.Device) (C.nvmlDevice_t, bool) {
+	value := reflect.ValueOf(device)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, false
+	}
+	handle := value.FieldByName("Handle")
+	if !handle.IsValid() || handle.Kind() != reflect.Ptr || handle.IsNil() {
+		return nil, false
+	}
+	return C.nvmlDevice_t(handle.UnsafePointer()), true
+}
+
+// Most attempts at reading a clock list whose length keeps changing
+const clockListAttempts = 3
+
+// Read a list of clocks from an NVML query that takes a count and a buffer.
+// A one-element probe returns the list size with ERROR_INSUFFICIENT_SIZE, then
+// the query is repeated with a buffer of that size, growing it if the list has
+// grown in between.
+func readClockList(query func(count, clocks *uint32) nvml.Return) ([]uint32, nvml.Return) {
+	buffer := make([]uint32, 1)
+	for attempt := 0; attempt < clockListAttempts; attempt++ {
+		count := uint32(len(buffer))
+		ret := query(&count, &buffer[0])
+		if ret == nvml.SUCCESS {
+			return buffer[:min(int(count), len(buffer))], nvml.SUCCESS
+		}
+		if ret != nvml.ERROR_INSUFFICIENT_SIZE {
+			return nil, ret
+		}
+		buffer = make([]uint32, max(int(count), 2*len(buffer)))
+	}
+	return nil, nvml.ERROR_INSUFFICIENT_SIZE
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "fmt"
+
+// Syslog isn't available on this platform
+func logToSyslog() error {
+	return fmt.Errorf("syslog is not supported on this platform")
+}
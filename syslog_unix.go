@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+// Writer for log output that doesn't come with a severity, such as errors from
+// net/http, which goes to syslog/journald as info
+type syslogWriter struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	return len(p), s.writer.Info(strings.TrimSpace(string(p)))
+}
+
+// Send log output to the local syslog daemon, which journald also reads, with
+// the severity logInfo, logWarning or logError gave it
+func logToSyslog() error {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "nvidia-power-control")
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0) // syslog adds its own timestamp
+	log.SetOutput(&syslogWriter{writer: writer})
+	severityLog = func(severity logSeverity, message string) {
+		switch severity {
+		case severityError:
+			writer.Err(message)
+		case severityWarning:
+			writer.Warning(message)
+		default:
+			writer.Info(message)
+		}
+	}
+	return nil
+}